@@ -2,47 +2,163 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 )
 
 type Config struct {
-	ImageURLFile              string
+	ImageURLFiles             []string
+	InputFormat               string
+	InputURLType              string
+	SitemapModifiedSince      time.Time
+	FeedMIMETypes             []string
+	FeedStateFile             string
+	IIIFSize                  string
+	IIIFQuality               string
+	IIIFFormat                string
+	CSVHeader                 bool
+	CSVURLColumn              string
+	CSVFilenameColumns        []string
+	CSVSubdirColumns          []string
+	PriorityWindow            int
+	StrictInput               bool
+	RejectedLinesFile         string
+	ExpandURLBraces           bool
+	NormalizeURLs             []string
+	StripQueryParams          []string
+	DedupeURLs                bool
 	DownloadDirectory         string
+	FilenameTemplate          *FilenameTemplate
+	ExtensionPolicy           ExtensionPolicy
 	BatchSize                 int
+	Concurrency               int
 	MinWaitTime               float64
 	MaxWaitTime               float64
-	MaxImageSizeMB            string
+	MaxImageSize              int64
+	SizePrecheck              bool
 	ReplaceDownloadedFileSize bool
 	SkipIfFileExists          bool
+	RetryMaxAttempts          int
+	RetryBaseDelay            float64
+	RetryMaxDelay             float64
+	RetryJitter               float64
+	RetryStatusCodes          []int
+	RetryNetworkErrors        []string
+	FailFast                  bool
+	FailedURLFile             string
+	HTTPTimeout               float64
+	SegmentThreshold          int64
+	SegmentCount              int
 }
 
+// existingFilePolicy maps skip_if_file_exists and replace_downloaded_file_size
+// to an ExistingFilePolicy. Skipping takes precedence over replacing.
+func existingFilePolicy(config *Config) ExistingFilePolicy {
+	switch {
+	case config.SkipIfFileExists:
+		return SkipExisting
+	case config.ReplaceDownloadedFileSize:
+		return ReplaceOnSizeMismatch
+	default:
+		return OverwriteExisting
+	}
+}
+
+// csvColumns collects the csv_* keys into the CSVColumns of the CSV reader.
+func csvColumns(config *Config) CSVColumns {
+	return CSVColumns{
+		Header:   config.CSVHeader,
+		URL:      config.CSVURLColumn,
+		Filename: config.CSVFilenameColumns,
+		Subdir:   config.CSVSubdirColumns,
+	}
+}
+
+// parseMaxImageSize parses a size limit, returning -1 for "MAX" (no limit). A
+// bare number is a size in mebibytes, as the max_image_size_mb key suggests.
 func parseMaxImageSize(size string) (int64, error) {
-	if size == "MAX" {
+	size = strings.TrimSpace(size)
+	if strings.EqualFold(size, "MAX") {
 		return -1, nil
 	}
 
+	if mb, err := strconv.ParseFloat(size, 64); err == nil && mb >= 0 {
+		return parseSize(size + "MiB")
+	}
+
 	return parseSize(size)
 }
 
+// sizeUnits maps the lower-cased size units to their number of bytes. KB, MB,
+// GB and TB have always meant multiples of 1024 here, so they are the same as
+// the IEC units KiB, MiB, GiB and TiB. The decimal SI units are spelled with an
+// _SI suffix, as in KB_SI for 1000 bytes.
+var sizeUnits = map[string]float64{
+	"b":     1,
+	"kb":    1 << 10,
+	"mb":    1 << 20,
+	"gb":    1 << 30,
+	"tb":    1 << 40,
+	"kib":   1 << 10,
+	"mib":   1 << 20,
+	"gib":   1 << 30,
+	"tib":   1 << 40,
+	"kb_si": 1e3,
+	"mb_si": 1e6,
+	"gb_si": 1e9,
+	"tb_si": 1e12,
+}
+
+// parseSize parses a size with a unit suffix (e.g. 500KB, 1.5 GB, 2GiB, 20MB_SI) into bytes.
 func parseSize(size string) (int64, error) {
-	// Parse size with unit suffix (e.g., 10KB, 1MB, 1GB)
-	var value int64
-	var unit string
-	_, err := fmt.Sscanf(size, "%d%s", &value, &unit)
+	trimmed := strings.TrimSpace(size)
+	unitStart := strings.IndexFunc(trimmed, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if unitStart <= 0 {
+		return 0, fmt.Errorf("failed to parse size %q: expected a number followed by a unit", size)
+	}
+
+	value, err := strconv.ParseFloat(trimmed[:unitStart], 64)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse size: %w", err)
+		return 0, fmt.Errorf("failed to parse size %q: %w", size, err)
 	}
 
 	// Convert size to bytes
-	switch unit {
-	case "B":
-		return value, nil
-	case "KB":
-		return value * 1024, nil
-	case "MB":
-		return value * 1024 * 1024, nil
-	case "GB":
-		return value * 1024 * 1024 * 1024, nil
-	default:
+	unit := strings.TrimSpace(trimmed[unitStart:])
+	multiplier, ok := sizeUnits[strings.ToLower(unit)]
+	if !ok {
 		return 0, fmt.Errorf("invalid size unit: %s", unit)
 	}
+
+	bytes := math.Round(value * multiplier)
+	if bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", size)
+	}
+
+	return int64(bytes), nil
+}
+
+// parseModifiedSince parses the sitemap_modified_since key: a date or time
+// such as 2024-05-01 or 2024-05-01T12:00:00Z, or a duration before now such
+// as 36h or 7d. An empty value means no limit and returns the zero time.
+func parseModifiedSince(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+
+	return parseW3CDatetime(value)
 }
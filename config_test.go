@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -139,3 +140,250 @@ skip_if_file_exists: true
 		t.Errorf("Expected default skip if file exists to be %v, but got %v", defaultSkipIfExists, viper.GetBool("skip_if_file_exists"))
 	}
 }
+
+func TestExistingFilePolicy(t *testing.T) {
+	tests := []struct {
+		skip     bool
+		replace  bool
+		expected ExistingFilePolicy
+	}{
+		{skip: true, replace: false, expected: SkipExisting},
+		{skip: true, replace: true, expected: SkipExisting},
+		{skip: false, replace: true, expected: ReplaceOnSizeMismatch},
+		{skip: false, replace: false, expected: OverwriteExisting},
+	}
+
+	for _, tt := range tests {
+		config := &Config{SkipIfFileExists: tt.skip, ReplaceDownloadedFileSize: tt.replace}
+		if policy := existingFilePolicy(config); policy != tt.expected {
+			t.Errorf("Expected policy %d for skip=%v replace=%v, but got %d", tt.expected, tt.skip, tt.replace, policy)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"512B":      512,
+		"500KB":     500 * 1024,
+		"500kB":     500 * 1024,
+		"2GB":       2 * 1024 * 1024 * 1024,
+		"1.5 MB":    1536 * 1024,
+		"500KiB":    500 * 1024,
+		"2GiB":      2 * 1024 * 1024 * 1024,
+		"0.5mib":    512 * 1024,
+		" 1TB ":     1024 * 1024 * 1024 * 1024,
+		"10 MiB ":   10 * 1024 * 1024,
+		"500KB_SI":  500 * 1000,
+		"500kb_si":  500 * 1000,
+		"1.5 MB_SI": 1500 * 1000,
+		"2GB_SI":    2 * 1000 * 1000 * 1000,
+		"1TB_SI":    1000 * 1000 * 1000 * 1000,
+	}
+
+	for size, expected := range tests {
+		actual, err := parseSize(size)
+		if err != nil {
+			t.Errorf("Failed to parse size %q: %v", size, err)
+		} else if actual != expected {
+			t.Errorf("Expected size %q to be %d bytes, but got %d", size, expected, actual)
+		}
+	}
+
+	for _, size := range []string{"", "MB", "10", "10XB", "10KB_", "10SI", "1.2.3MB", "-5MB", "99999999999TB"} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("Expected an error when parsing size %q, but got nil", size)
+		}
+	}
+}
+
+func TestParseMaxImageSize_Units(t *testing.T) {
+	size, err := parseMaxImageSize("max")
+	if err != nil || size != -1 {
+		t.Errorf("Expected max to mean no limit, but got %d (%v)", size, err)
+	}
+
+	size, err = parseMaxImageSize("2.5")
+	if err != nil || size != 2.5*1024*1024 {
+		t.Errorf("Expected a bare number to be mebibytes, but got %d (%v)", size, err)
+	}
+
+	size, err = parseMaxImageSize("500KB")
+	if err != nil || size != 500*1024 {
+		t.Errorf("Expected 500KB to be %d bytes, but got %d (%v)", 500*1024, size, err)
+	}
+}
+
+func TestNewConfig_RejectsInvalidSize(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("batch_size", 2)
+	viper.Set("segment_threshold", "0")
+	viper.Set("max_image_size_mb", "lots")
+	if _, err := newConfig(); err == nil {
+		t.Errorf("Expected an error for an invalid max_image_size_mb, but got nil")
+	}
+
+	viper.Set("max_image_size_mb", "2GB")
+	config, err := newConfig()
+	if err != nil {
+		t.Fatalf("Failed to build configuration: %v", err)
+	}
+	if config.MaxImageSize != 2*1024*1024*1024 {
+		t.Errorf("Expected max image size to be 2GB, but got %d", config.MaxImageSize)
+	}
+}
+
+func TestNewConfig_InputFormat(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("batch_size", 2)
+	viper.Set("max_image_size_mb", "MAX")
+	viper.Set("segment_threshold", "0")
+	viper.Set("input_format", "XML")
+	if _, err := newConfig(); err == nil {
+		t.Errorf("Expected an error for an unknown input_format, but got nil")
+	}
+
+	viper.Set("input_format", "CSV")
+	viper.Set("csv_url_column", "image_url")
+	viper.Set("csv_filename_columns", []string{"sku", "angle"})
+	config, err := newConfig()
+	if err != nil {
+		t.Fatalf("Failed to build configuration: %v", err)
+	}
+	if config.InputFormat != InputFormatCSV {
+		t.Errorf("Expected input format %q, but got %q", InputFormatCSV, config.InputFormat)
+	}
+	columns := csvColumns(config)
+	if columns.URL != "image_url" || len(columns.Filename) != 2 {
+		t.Errorf("Unexpected CSV columns: %+v", columns)
+	}
+}
+
+func TestNewConfig_InputURLType(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("batch_size", 2)
+	viper.Set("max_image_size_mb", "MAX")
+	viper.Set("segment_threshold", "0")
+	viper.Set("input_url_type", "gallery")
+	if _, err := newConfig(); err == nil {
+		t.Errorf("Expected an error for an unknown input_url_type, but got nil")
+	}
+
+	viper.Set("input_url_type", "HTML")
+	config, err := newConfig()
+	if err != nil {
+		t.Fatalf("Failed to build configuration: %v", err)
+	}
+	if config.InputURLType != InputURLHTML {
+		t.Errorf("Expected input URL type %q, but got %q", InputURLHTML, config.InputURLType)
+	}
+}
+
+func TestParseModifiedSince(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Time{
+		"":                     {},
+		"36h":                  time.Date(2024, 5, 9, 0, 0, 0, 0, time.UTC),
+		"7d":                   time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC),
+		"2024-05-01":           time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		"2024-05-01T06:00:00Z": time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC),
+	} {
+		got, err := parseModifiedSince(value, now)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", value, err)
+		} else if !got.Equal(want) {
+			t.Errorf("Expected %q to be %v, but got %v", value, want, got)
+		}
+	}
+
+	for _, value := range []string{"yesterday", "-7d", "-1h"} {
+		if _, err := parseModifiedSince(value, now); err == nil {
+			t.Errorf("Expected an error for %q, but got nil", value)
+		}
+	}
+}
+
+func TestImageURLFiles(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("image_url_file", "my urls.txt")
+	if files := imageURLFiles(); len(files) != 1 || files[0] != "my urls.txt" {
+		t.Errorf("Expected a single file, but got %q", files)
+	}
+
+	viper.Set("image_url_file", []interface{}{"-", "lists/*.txt"})
+	if files := imageURLFiles(); len(files) != 2 || files[0] != "-" || files[1] != "lists/*.txt" {
+		t.Errorf("Expected two files, but got %q", files)
+	}
+}
+
+func TestNewConfig_RejectsInvalidNormalization(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("batch_size", 2)
+	viper.Set("max_image_size_mb", "MAX")
+	viper.Set("segment_threshold", "0")
+	viper.Set("normalize_urls", []string{"lowercase_host", "lowercase_everything"})
+	if _, err := newConfig(); err == nil {
+		t.Errorf("Expected an error for an unknown normalize_urls rule, but got nil")
+	}
+}
+
+func TestNewConfig_FilenameTemplate(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("batch_size", 2)
+	viper.Set("max_image_size_mb", "MAX")
+	viper.Set("segment_threshold", "0")
+	config, err := newConfig()
+	if err != nil {
+		t.Fatalf("Failed to build configuration: %v", err)
+	}
+	if config.FilenameTemplate != nil {
+		t.Errorf("Expected no filename template, but got %q", config.FilenameTemplate)
+	}
+
+	viper.Set("filename_template", "{host}/{nme}")
+	if _, err := newConfig(); err == nil {
+		t.Errorf("Expected an error for an unknown filename_template field, but got nil")
+	}
+
+	viper.Set("filename_template", "{host}/{name}")
+	config, err = newConfig()
+	if err != nil {
+		t.Fatalf("Failed to build configuration: %v", err)
+	}
+	if config.FilenameTemplate.String() != "{host}/{name}" {
+		t.Errorf("Expected filename template %q, but got %q", "{host}/{name}", config.FilenameTemplate)
+	}
+}
+
+func TestNewConfig_ExtensionPolicy(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	viper.Set("batch_size", 2)
+	viper.Set("max_image_size_mb", "MAX")
+	viper.Set("segment_threshold", "0")
+	viper.Set("extension_policy", "rename")
+	if _, err := newConfig(); err == nil {
+		t.Errorf("Expected an error for an unknown extension_policy, but got nil")
+	}
+
+	viper.Set("extension_policy", "fix")
+	config, err := newConfig()
+	if err != nil {
+		t.Fatalf("Failed to build configuration: %v", err)
+	}
+	if config.ExtensionPolicy != FixExtension {
+		t.Errorf("Expected extension policy %v, but got %v", FixExtension, config.ExtensionPolicy)
+	}
+}
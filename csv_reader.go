@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// CSVColumns says which columns of a CSV or TSV file make up an image request.
+// A column is given by its header name or its 1-based position.
+type CSVColumns struct {
+	// Header is set if the first row names the columns.
+	Header bool
+	URL    string
+	// The values of the Filename columns are joined with underscores and
+	// given the extension of the URL. The Subdir columns each add a directory.
+	Filename []string
+	Subdir   []string
+}
+
+// CSVURLReader reads image requests from a CSV or TSV file.
+type CSVURLReader struct {
+	Comma   rune
+	Columns CSVColumns
+}
+
+func NewCSVURLReader(comma rune, columns CSVColumns) *CSVURLReader {
+	return &CSVURLReader{Comma: comma, Columns: columns}
+}
+
+// csvColumnIndexes are the resolved 0-based positions of the CSVColumns.
+type csvColumnIndexes struct {
+	url      int
+	filename []int
+	subdir   []int
+	// header names the columns, if the file has a header row.
+	header []string
+}
+
+func (r *CSVURLReader) OpenImageRequests(ctx context.Context, filePath string) (ImageRequestStream, error) {
+	file, err := openInput(ctx, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	stream, err := r.newStream(inputName(filePath), file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// newStream reads the header row, if any, and resolves the columns.
+func (r *CSVURLReader) newStream(filePath string, file io.ReadCloser) (*csvStream, error) {
+	reader := csv.NewReader(file)
+	reader.Comma = r.Comma
+	reader.ReuseRecord = true
+
+	stream := &csvStream{path: filePath, file: file, reader: reader}
+
+	var header []string
+	if r.Columns.Header {
+		record, err := reader.Read()
+		if err == io.EOF {
+			// Nothing to read, not even the header
+			return stream, nil
+		}
+		if err != nil {
+			return nil, csvError(filePath, err)
+		}
+		header = append(header, record...)
+		// Spreadsheet exports like to start with a byte order mark
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	columns, err := r.resolveColumns(header)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	stream.columns = columns
+
+	return stream, nil
+}
+
+// csvStream reads the requests of a CSV or TSV file one row at a time.
+type csvStream struct {
+	path    string
+	file    io.ReadCloser
+	reader  *csv.Reader
+	columns *csvColumnIndexes
+	line    int
+}
+
+func (s *csvStream) Next() (ImageRequest, error) {
+	record, err := s.reader.Read()
+	if err == io.EOF {
+		return ImageRequest{}, io.EOF
+	}
+	if err != nil {
+		return ImageRequest{}, csvError(s.path, err)
+	}
+
+	s.line, _ = s.reader.FieldPos(0)
+	req, err := s.columns.imageRequest(record)
+	if err != nil {
+		return ImageRequest{}, &InputLineError{File: s.path, Line: s.line, Text: strings.Join(record, string(s.reader.Comma)), Err: err}
+	}
+
+	return req, nil
+}
+
+func (s *csvStream) lastLine() int {
+	return s.line
+}
+
+func (s *csvStream) Close() error {
+	return s.file.Close()
+}
+
+// resolveColumns looks up the configured columns in the header, if any.
+func (r *CSVURLReader) resolveColumns(header []string) (*csvColumnIndexes, error) {
+	urlColumn, err := columnIndex(r.Columns.URL, header)
+	if err != nil {
+		return nil, fmt.Errorf("url column: %v", err)
+	}
+
+	columns := &csvColumnIndexes{url: urlColumn, header: header}
+	for _, name := range r.Columns.Filename {
+		index, err := columnIndex(name, header)
+		if err != nil {
+			return nil, fmt.Errorf("filename column: %v", err)
+		}
+		columns.filename = append(columns.filename, index)
+	}
+	for _, name := range r.Columns.Subdir {
+		index, err := columnIndex(name, header)
+		if err != nil {
+			return nil, fmt.Errorf("subdir column: %v", err)
+		}
+		columns.subdir = append(columns.subdir, index)
+	}
+
+	return columns, nil
+}
+
+// columnIndex returns the 0-based position of the column, given by its name in
+// the header or by its 1-based position.
+func columnIndex(column string, header []string) (int, error) {
+	column = strings.TrimSpace(column)
+	for i, name := range header {
+		if strings.EqualFold(strings.TrimSpace(name), column) {
+			return i, nil
+		}
+	}
+
+	position, err := strconv.Atoi(column)
+	if err != nil || position < 1 {
+		if header == nil {
+			return 0, fmt.Errorf("%q is not a column number, and there is no header row to look it up in", column)
+		}
+		return 0, fmt.Errorf("no column named %q", column)
+	}
+
+	return position - 1, nil
+}
+
+func (c *csvColumnIndexes) imageRequest(record []string) (ImageRequest, error) {
+	value := func(index int) (string, error) {
+		if index >= len(record) {
+			return "", fmt.Errorf("missing column %d, the row has %d", index+1, len(record))
+		}
+		return strings.TrimSpace(record[index]), nil
+	}
+
+	imageURL, err := value(c.url)
+	if err != nil {
+		return ImageRequest{}, err
+	}
+	if imageURL == "" {
+		return ImageRequest{}, errors.New("empty url")
+	}
+	if err := validateImageURL(imageURL); err != nil {
+		return ImageRequest{}, err
+	}
+	req := ImageRequest{URL: imageURL}
+
+	var nameParts []string
+	for _, index := range c.filename {
+		part, err := value(index)
+		if err != nil {
+			return ImageRequest{}, err
+		}
+		if part != "" {
+			nameParts = append(nameParts, sanitizePathElement(part))
+		}
+	}
+	if len(nameParts) > 0 {
+		req.Filename = strings.Join(nameParts, "_") + urlExtension(imageURL)
+	}
+
+	var subdirs []string
+	for _, index := range c.subdir {
+		subdir, err := value(index)
+		if err != nil {
+			return ImageRequest{}, err
+		}
+		if subdir != "" {
+			subdirs = append(subdirs, sanitizePathElement(subdir))
+		}
+	}
+	req.Subdir = path.Join(subdirs...)
+
+	// The other named columns are metadata for the filename_template
+	for i, name := range c.header {
+		if name = strings.TrimSpace(name); name != "" && i != c.url && i < len(record) {
+			if req.Metadata == nil {
+				req.Metadata = make(map[string]string, len(c.header))
+			}
+			req.Metadata[name] = strings.TrimSpace(record[i])
+		}
+	}
+
+	return req, nil
+}
+
+// sanitizePathElement makes value safe to use as a single file or directory name.
+func sanitizePathElement(value string) string {
+	value = strings.NewReplacer("/", "_", "\\", "_").Replace(value)
+	if value == "." || value == ".." {
+		return "_"
+	}
+	return value
+}
+
+// urlExtension returns the extension of the last element of the URL path.
+func urlExtension(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return path.Ext(parsed.Path)
+}
+
+// csvError adds the file name to err. Parse errors become an InputLineError
+// for their line.
+func csvError(filePath string, err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return &InputLineError{File: filePath, Line: parseErr.Line, Err: parseErr.Err}
+	}
+	return fmt.Errorf("failed to read file: %w", err)
+}
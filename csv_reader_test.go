@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSVURLReader(t *testing.T) {
+	csvFile := createTempFile(t, []byte("\ufeffSKU,Angle,Image URL\n"+
+		"A-100,front,https://example.com/img/8f3a.jpg?w=800\n"+
+		"\"A/200\",\"side, left\",https://example.com/img/91c2.png\n"+
+		"A-300,,https://example.com/img/noext\n"))
+	defer os.Remove(csvFile)
+
+	reader := NewCSVURLReader(',', CSVColumns{
+		Header:   true,
+		URL:      "image url",
+		Filename: []string{"sku", "angle"},
+		Subdir:   []string{"1"},
+	})
+	requests, err := readAllImageRequests(reader, csvFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{
+		{URL: "https://example.com/img/8f3a.jpg?w=800", Filename: "A-100_front.jpg", Subdir: "A-100",
+			Metadata: map[string]string{"SKU": "A-100", "Angle": "front"}},
+		{URL: "https://example.com/img/91c2.png", Filename: "A_200_side, left.png", Subdir: "A_200",
+			Metadata: map[string]string{"SKU": "A/200", "Angle": "side, left"}},
+		{URL: "https://example.com/img/noext", Filename: "A-300", Subdir: "A-300",
+			Metadata: map[string]string{"SKU": "A-300", "Angle": ""}},
+	}, requests)
+}
+
+func TestCSVURLReader_TSVWithoutHeader(t *testing.T) {
+	tsvFile := createTempFile(t, []byte("A-100\thttps://example.com/a.jpg\nA-200\thttps://example.com/b.jpg\n"))
+	defer os.Remove(tsvFile)
+
+	requests, err := readAllImageRequests(NewCSVURLReader('\t', CSVColumns{URL: "2"}), tsvFile)
+	assert.NoError(t, err)
+	assert.Equal(t, imageRequests("https://example.com/a.jpg", "https://example.com/b.jpg"), requests)
+}
+
+func TestCSVURLReader_Malformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		columns CSVColumns
+		err     string
+	}{
+		{"field count", "sku,url\nA,https://example.com/a.jpg\nB\n", CSVColumns{Header: true, URL: "url"}, ":3: wrong number of fields"},
+		{"bare quote", "sku,url\nA,https://example.com/a.jpg\nB,https://\"example.com/b.jpg\n", CSVColumns{Header: true, URL: "url"}, ":3:"},
+		{"empty url", "sku,url\nA,https://example.com/a.jpg\nB, \n", CSVColumns{Header: true, URL: "url"}, ":3: empty url"},
+		{"bad url", "sku,url\nA,mailto:someone@example.com\n", CSVColumns{Header: true, URL: "url"}, ":2: invalid URL"},
+		{"unknown column", "sku,url\n", CSVColumns{Header: true, URL: "link"}, `no column named "link"`},
+		{"name without header", "A,https://example.com/a.jpg\n", CSVColumns{URL: "url"}, "no header row"},
+		{"missing column", "https://example.com/a.jpg\n", CSVColumns{URL: "2"}, ":1: missing column 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csvFile := createTempFile(t, []byte(tt.content))
+			defer os.Remove(csvFile)
+
+			_, err := readAllImageRequests(NewCSVURLReader(',', tt.columns), csvFile)
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestFormatURLReader_CSV(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "images.csv")
+	assert.NoError(t, os.WriteFile(csvFile, []byte("url\nhttps://example.com/a.jpg\n"), 0644))
+
+	reader := NewFormatURLReader(InputFormatAuto)
+	reader.CSVColumns = CSVColumns{Header: true, URL: "url"}
+	requests, err := readAllImageRequests(reader, csvFile)
+	assert.NoError(t, err)
+	assert.Equal(t, imageRequests("https://example.com/a.jpg"), requests)
+}
+
+func TestCSVURLReader_LongLines(t *testing.T) {
+	longURL := "https://example.com/image.jpg?q=" + strings.Repeat("a", 100*1024)
+	csvFile := createTempFile(t, []byte("url\n"+longURL+"\nhttps://example.com/b.jpg\n"))
+	defer os.Remove(csvFile)
+
+	requests, err := readAllImageRequests(NewCSVURLReader(',', CSVColumns{Header: true, URL: "url"}), csvFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{longURL, "https://example.com/b.jpg"}, requestURLs(requests))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxDocumentSize bounds a decompressed sitemap or feed, twice the 50MB the
+// sitemap protocol allows.
+const maxDocumentSize = 100 << 20
+
+// ErrInputTooLarge is returned for a sitemap or feed larger than
+// maxDocumentSize.
+var ErrInputTooLarge = errors.New("input too large")
+
+// document is an XML or JSON input, such as a sitemap or a feed, read from a
+// file, standard input or an http or https URL, and decompressed if it is
+// gzipped.
+type document struct {
+	*bufio.Reader
+	name string
+	body io.Closer
+}
+
+func (d *document) Close() error {
+	return d.body.Close()
+}
+
+// openDocument opens the document at location. URLs are fetched with the
+// client under the retry policy, and given up on when ctx is cancelled.
+func openDocument(ctx context.Context, client HTTPClient, retryPolicy *RetryPolicy, location string) (*document, error) {
+	var body io.ReadCloser
+	var err error
+	if isRemoteInput(location) {
+		body, err = fetchDocument(ctx, client, retryPolicy, location)
+	} else {
+		body, err = openInput(ctx, location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers often send .gz files without a Content-Encoding
+	buffered := bufio.NewReader(body)
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			body.Close()
+			return nil, fmt.Errorf("failed to decompress %s: %v", inputName(location), err)
+		}
+		buffered = bufio.NewReader(gz)
+	}
+
+	return &document{
+		Reader: bufio.NewReader(&sizeLimitedReader{r: buffered, n: maxDocumentSize}),
+		name:   inputName(location),
+		body:   body,
+	}, nil
+}
+
+// fetchDocument downloads the document at location into a temporary file,
+// which is removed when it is closed. Documents are read as the downloads go,
+// and the HTTP timeout would otherwise cut off reading the rest of a large one.
+func fetchDocument(ctx context.Context, client HTTPClient, retryPolicy *RetryPolicy, location string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := retryPolicy.Do(ctx, "fetch "+location, func() error {
+		req, err := newImageRequest(ctx, ImageRequest{URL: location})
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", location, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to fetch %s, %w", location, &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+		}
+
+		body, err = spoolDocument(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", location, err)
+		}
+		return nil
+	})
+
+	return body, err
+}
+
+// spoolDocument copies r into a temporary file and returns the file, rewound.
+func spoolDocument(r io.Reader) (*spooledFile, error) {
+	file, err := os.CreateTemp("", "document-*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledFile{file}
+
+	// Sitemaps and feeds compress well, the limit on their contents holds here too
+	_, err = io.Copy(file, &sizeLimitedReader{r: r, n: maxDocumentSize})
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, err
+	}
+
+	return spooled, nil
+}
+
+// spooledFile is a temporary file that is removed when it is closed.
+type spooledFile struct {
+	*os.File
+}
+
+func (f *spooledFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// requestResult is a request read from a document, or the error of an entry.
+type requestResult struct {
+	req ImageRequest
+	err error
+}
+
+// resultStream yields requests read up front.
+type resultStream struct {
+	results []requestResult
+}
+
+func (s *resultStream) Next() (ImageRequest, error) {
+	if len(s.results) == 0 {
+		return ImageRequest{}, io.EOF
+	}
+
+	result := s.results[0]
+	s.results = s.results[1:]
+	return result.req, result.err
+}
+
+func (s *resultStream) Close() error {
+	return nil
+}
+
+// isJSON reports whether the document holds a JSON object.
+func (d *document) isJSON() bool {
+	head, _ := d.Peek(512)
+	head = bytes.TrimPrefix(head, []byte("\ufeff"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+	return len(head) > 0 && head[0] == '{'
+}
+
+// sniffInputFormat tells sitemaps, feeds and IIIF manifests apart by the start
+// of the document: the name of the root element of XML, the JSON Feed version
+// or IIIF context of JSON. It returns "" for anything else.
+func sniffInputFormat(doc *document) string {
+	if doc.isJSON() {
+		// Both put what they are near the top
+		head, _ := doc.Peek(4096)
+		switch {
+		case bytes.Contains(head, []byte("iiif.io/api/presentation")):
+			return InputFormatIIIF
+		case bytes.Contains(head, []byte("jsonfeed.org")):
+			return InputFormatFeed
+		}
+		return ""
+	}
+
+	head, _ := doc.Peek(1024)
+	decoder := xml.NewDecoder(bytes.NewReader(head))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+
+		if start, ok := token.(xml.StartElement); ok {
+			switch start.Name.Local {
+			case "urlset", "sitemapindex":
+				return InputFormatSitemap
+			case "rss", "feed", "RDF":
+				return InputFormatFeed
+			}
+			return ""
+		}
+	}
+}
+
+// isRemoteInput reports whether an input path is an http or https URL.
+func isRemoteInput(path string) bool {
+	lower := strings.ToLower(path)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// sizeLimitedReader reads at most n bytes of r and fails with ErrInputTooLarge
+// if there are more.
+type sizeLimitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Only fail if there really is more to read
+		var probe [1]byte
+		if n, _ := l.r.Read(probe[:]); n > 0 {
+			return 0, ErrInputTooLarge
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniffInputFormat(t *testing.T) {
+	for contents, want := range map[string]string{
+		imageSitemap(""): InputFormatSitemap,
+		`<?xml version="1.0"?><!-- index --><sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"/>`: InputFormatSitemap,
+		`<?xml version="1.0"?><rss version="2.0"><channel/></rss>`:                                               InputFormatFeed,
+		`<feed xmlns="http://www.w3.org/2005/Atom"/>`:                                                            InputFormatFeed,
+		"\ufeff\n {\"version\": \"https://jsonfeed.org/version/1.1\", \"items\": []}":                            InputFormatFeed,
+		`{"@context": "http://iiif.io/api/presentation/3/context.json", "type": "Manifest"}`:                     InputFormatIIIF,
+		`<html><body/></html>`:      "",
+		`https://example.com/a.jpg`: "",
+	} {
+		file := createTempFile(t, []byte(contents))
+		doc, err := openDocument(context.Background(), nil, nil, file)
+		assert.NoError(t, err)
+		assert.Equal(t, want, sniffInputFormat(doc), contents)
+		assert.NoError(t, doc.Close())
+		os.Remove(file)
+	}
+}
+
+func TestOpenDocument_Gzip(t *testing.T) {
+	file := createTempFile(t, gzipped(t, imageSitemap("")))
+	defer os.Remove(file)
+
+	doc, err := openDocument(context.Background(), nil, nil, file)
+	assert.NoError(t, err)
+	defer doc.Close()
+	contents, err := io.ReadAll(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, imageSitemap(""), string(contents))
+}
+
+func TestOpenDocument_Canceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	policy := &RetryPolicy{MaxAttempts: 5, BaseDelay: time.Minute, MaxDelay: time.Minute,
+		RetryableStatusCodes: []int{http.StatusServiceUnavailable}}
+
+	// A cancelled run doesn't wait for the retries of a document
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := openDocument(ctx, NewStandardHTTPClient(), policy, server.URL+"/sitemap.xml")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestSizeLimitedReader(t *testing.T) {
+	data, err := io.ReadAll(&sizeLimitedReader{r: bytes.NewReader([]byte("12345")), n: 5})
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", string(data))
+
+	_, err = io.ReadAll(&sizeLimitedReader{r: bytes.NewReader([]byte("123456")), n: 5})
+	assert.ErrorIs(t, err, ErrInputTooLarge)
+}
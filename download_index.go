@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// downloadIndexName is the file in the download directory the DownloadIndex is
+// kept in.
+const downloadIndexName = ".download_index"
+
+// DownloadIndex records which URL each downloaded file was saved from, so that
+// a file already on disk is only taken for the download of its own URL, in
+// this run or a later one. The index file has one "URL, path" line per file,
+// separated by a tab, with the path relative to the download directory; like
+// the failed URL report, it can be read back as a list of URLs. In memory only
+// 64-bit hashes of the paths, ignoring case, and of the URLs are kept.
+//
+// Files without a record, such as those downloaded before the index existed,
+// belong to no URL in particular.
+type DownloadIndex struct {
+	// dir is the download directory, "" for an index only kept in memory.
+	dir string
+
+	mu     sync.Mutex
+	owners map[uint64]indexEntry
+	file   *os.File
+}
+
+// indexEntry is the URL a path was given to, and whether it was recorded or
+// only reserved for a download in progress.
+type indexEntry struct {
+	url   uint64
+	saved bool
+}
+
+// LoadDownloadIndex loads the index of the download directory dir, a missing
+// index file being an empty index.
+func LoadDownloadIndex(dir string) (*DownloadIndex, error) {
+	index := &DownloadIndex{dir: dir, owners: make(map[uint64]indexEntry)}
+
+	file, err := os.Open(filepath.Join(dir, downloadIndexName))
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if url, rel, ok := strings.Cut(strings.TrimRight(line, "\r\n"), "\t"); ok {
+			index.owners[indexKey(filepath.Join(dir, filepath.FromSlash(rel)))] = indexEntry{url: hashStrings(url), saved: true}
+		}
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file.Name(), err)
+		}
+	}
+}
+
+// indexKey is the key of filePath in the index.
+func indexKey(filePath string) uint64 {
+	return hashStrings(strings.ToLower(filepath.ToSlash(filepath.Clean(filePath))))
+}
+
+// owns reports whether filePath was given to url, and whether it was given to
+// any URL at all.
+func (x *DownloadIndex) owns(filePath, url string) (owned, known bool) {
+	if x == nil {
+		return false, false
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	entry, ok := x.owners[indexKey(filePath)]
+	return ok && entry.url == hashStrings(url), ok
+}
+
+// reserve gives filePath to url for the rest of the run, unless it was given
+// to another URL already, and tells whether filePath is url's.
+func (x *DownloadIndex) reserve(filePath, url string) bool {
+	if x == nil {
+		return true
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	key := indexKey(filePath)
+	hash := hashStrings(url)
+	if entry, ok := x.owners[key]; ok {
+		return entry.url == hash
+	}
+	if x.owners == nil {
+		x.owners = make(map[uint64]indexEntry)
+	}
+	x.owners[key] = indexEntry{url: hash}
+	return true
+}
+
+// release ends the reservation of filePath for url, unless the file was
+// recorded since, so reservations don't pile up over a run.
+func (x *DownloadIndex) release(filePath, url string) {
+	if x == nil {
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	key := indexKey(filePath)
+	if entry, ok := x.owners[key]; ok && !entry.saved && entry.url == hashStrings(url) {
+		delete(x.owners, key)
+	}
+}
+
+// record gives filePath, a file downloaded from url, to url and adds it to the
+// index file.
+func (x *DownloadIndex) record(filePath, url string) error {
+	if x == nil {
+		return nil
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	key := indexKey(filePath)
+	entry := indexEntry{url: hashStrings(url)}
+	if x.owners == nil {
+		x.owners = make(map[uint64]indexEntry)
+	}
+	if current, ok := x.owners[key]; ok && current.url == entry.url && current.saved {
+		return nil
+	}
+	if x.dir == "" {
+		entry.saved = true
+		x.owners[key] = entry
+		return nil
+	}
+
+	rel, err := filepath.Rel(x.dir, filePath)
+	if err != nil {
+		return err
+	}
+	if x.file == nil {
+		x.file, err = os.OpenFile(filepath.Join(x.dir, downloadIndexName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open download index: %v", err)
+		}
+	}
+	if _, err := fmt.Fprintf(x.file, "%s\t%s\n", url, filepath.ToSlash(rel)); err != nil {
+		return fmt.Errorf("failed to write download index: %v", err)
+	}
+
+	entry.saved = true
+	x.owners[key] = entry
+	return nil
+}
+
+// Close closes the index file. It is safe to call more than once.
+func (x *DownloadIndex) Close() error {
+	if x == nil {
+		return nil
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.file == nil {
+		return nil
+	}
+	err := x.file.Close()
+	x.file = nil
+	return err
+}
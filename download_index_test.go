@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadIndex(t *testing.T) {
+	dir := t.TempDir()
+	index, err := LoadDownloadIndex(dir)
+	assert.NoError(t, err)
+
+	photo := filepath.Join(dir, "books", "Photo.jpg")
+	assert.NoError(t, index.record(photo, "https://example.com/photo.jpg"))
+	assert.NoError(t, index.record(photo, "https://example.com/photo.jpg"))
+	assert.NoError(t, index.Close())
+
+	contents, err := os.ReadFile(filepath.Join(dir, downloadIndexName))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/photo.jpg\tbooks/Photo.jpg\n", string(contents))
+
+	// Paths are compared ignoring case
+	index, err = LoadDownloadIndex(dir)
+	assert.NoError(t, err)
+	owned, known := index.owns(filepath.Join(dir, "books", "photo.jpg"), "https://example.com/photo.jpg")
+	assert.True(t, owned)
+	assert.True(t, known)
+	owned, known = index.owns(photo, "https://example.org/photo.jpg")
+	assert.False(t, owned)
+	assert.True(t, known)
+	owned, known = index.owns(filepath.Join(dir, "other.jpg"), "https://example.com/photo.jpg")
+	assert.False(t, owned)
+	assert.False(t, known)
+
+	// Without a directory the index is only kept in memory
+	memory := &DownloadIndex{}
+	assert.NoError(t, memory.record(photo, "https://example.com/photo.jpg"))
+	owned, _ = memory.owns(photo, "https://example.com/photo.jpg")
+	assert.True(t, owned)
+	assert.NoError(t, memory.Close())
+
+	// Reservations only last until they are released, records stay
+	other := filepath.Join(dir, "other.jpg")
+	assert.True(t, memory.reserve(other, "https://example.com/other.jpg"))
+	assert.False(t, memory.reserve(other, "https://example.org/other.jpg"))
+	memory.release(other, "https://example.com/other.jpg")
+	assert.True(t, memory.reserve(other, "https://example.org/other.jpg"))
+	memory.release(photo, "https://example.com/photo.jpg")
+	owned, _ = memory.owns(photo, "https://example.com/photo.jpg")
+	assert.True(t, owned)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// braceRange matches the inside of a {first..last} or {first..last..step}
+// group. Limiting the numbers to 18 digits keeps their difference in an int64.
+var braceRange = regexp.MustCompile(`^(-?\d{1,18})\.\.(-?\d{1,18})(?:\.\.(-?\d{1,18}))?$`)
+
+// bracePattern is a URL with brace groups, such as img_{0001..2500}.jpg or
+// page{1..40}/{a,b,c}.png, that stands for one URL per combination of the
+// values of its groups.
+type bracePattern struct {
+	// literals surround the groups, there is one more of them than of groups.
+	literals []string
+	groups   []braceGroup
+}
+
+// braceGroup is either a list of alternatives or a range of numbers.
+type braceGroup struct {
+	alternatives []string
+
+	start int64
+	step  int64
+	count int64
+	width int
+}
+
+func (g *braceGroup) len() int64 {
+	if g.alternatives != nil {
+		return int64(len(g.alternatives))
+	}
+	return g.count
+}
+
+func (g *braceGroup) at(i int64) string {
+	if g.alternatives != nil {
+		return g.alternatives[i]
+	}
+	return fmt.Sprintf("%0*d", g.width, g.start+i*g.step)
+}
+
+// parseBracePattern finds the brace groups of s. Braces that hold neither a
+// comma nor a range are kept as they are, and groups don't nest. It returns
+// false if s has no groups.
+func parseBracePattern(s string) (*bracePattern, bool) {
+	pattern := &bracePattern{}
+	var literal strings.Builder
+	for {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(s[open+1:], '}')
+		if end < 0 {
+			break
+		}
+		end += open + 1
+
+		// An opening brace before the closing one starts the group instead
+		if nested := strings.LastIndexByte(s[:end], '{'); nested > open {
+			literal.WriteString(s[:nested])
+			s = s[nested:]
+			continue
+		}
+
+		group, ok := parseBraceGroup(s[open+1 : end])
+		if !ok {
+			literal.WriteString(s[:end+1])
+			s = s[end+1:]
+			continue
+		}
+
+		literal.WriteString(s[:open])
+		pattern.literals = append(pattern.literals, literal.String())
+		pattern.groups = append(pattern.groups, group)
+		literal.Reset()
+		s = s[end+1:]
+	}
+	literal.WriteString(s)
+	pattern.literals = append(pattern.literals, literal.String())
+
+	return pattern, len(pattern.groups) > 0
+}
+
+// parseBraceGroup parses the inside of a pair of braces.
+func parseBraceGroup(inside string) (braceGroup, bool) {
+	if match := braceRange.FindStringSubmatch(inside); match != nil {
+		return parseBraceRange(match[1], match[2], match[3])
+	}
+	if strings.Contains(inside, ",") {
+		return braceGroup{alternatives: strings.Split(inside, ",")}, true
+	}
+	return braceGroup{}, false
+}
+
+// parseBraceRange parses a numeric range. If either end has a leading zero
+// the numbers are padded with zeros to the width of the longer end.
+func parseBraceRange(first, last, step string) (braceGroup, bool) {
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if err1 != nil || err2 != nil {
+		return braceGroup{}, false
+	}
+
+	stride := int64(1)
+	if step != "" {
+		var err error
+		stride, err = strconv.ParseInt(step, 10, 64)
+		if err != nil || stride == 0 {
+			return braceGroup{}, false
+		}
+		if stride < 0 {
+			stride = -stride
+		}
+	}
+
+	count := (end-start)/stride + 1
+	if end < start {
+		count = (start-end)/stride + 1
+		stride = -stride
+	}
+
+	group := braceGroup{start: start, step: stride, count: count}
+	if zeroPadded(first) || zeroPadded(last) {
+		group.width = len(first)
+		if len(last) > group.width {
+			group.width = len(last)
+		}
+	}
+
+	return group, true
+}
+
+func zeroPadded(number string) bool {
+	digits := strings.TrimPrefix(number, "-")
+	return len(digits) > 1 && digits[0] == '0'
+}
+
+// first returns the first string the pattern expands to.
+func (p *bracePattern) first() string {
+	expansion := p.expand()
+	s, _ := expansion.next()
+	return s
+}
+
+// expand returns an iterator over the strings the pattern stands for, the last
+// group changing fastest.
+func (p *bracePattern) expand() *braceExpansion {
+	return &braceExpansion{pattern: p, indexes: make([]int64, len(p.groups))}
+}
+
+// braceExpansion yields the expansions of a bracePattern one at a time.
+type braceExpansion struct {
+	pattern *bracePattern
+	indexes []int64
+	done    bool
+}
+
+func (e *braceExpansion) next() (string, bool) {
+	if e.done {
+		return "", false
+	}
+
+	var b strings.Builder
+	for i, group := range e.pattern.groups {
+		b.WriteString(e.pattern.literals[i])
+		b.WriteString(group.at(e.indexes[i]))
+	}
+	b.WriteString(e.pattern.literals[len(e.pattern.groups)])
+
+	// Advance like an odometer
+	e.done = true
+	for i := len(e.indexes) - 1; i >= 0; i-- {
+		e.indexes[i]++
+		if e.indexes[i] < e.pattern.groups[i].len() {
+			e.done = false
+			break
+		}
+		e.indexes[i] = 0
+	}
+
+	return b.String(), true
+}
+
+// expandingStream replaces the requests whose URL has brace groups with one
+// request per expanded URL, generating them as they are read. The expanded
+// requests share the other options of the original one, so a pattern that
+// names its file or gives its checksum is rejected: every expansion would be
+// saved to, or checked as, the same file.
+type expandingStream struct {
+	source ImageRequestStream
+	// name is the input file, for rejected patterns.
+	name      string
+	current   ImageRequest
+	expansion *braceExpansion
+}
+
+func newExpandingStream(source ImageRequestStream, name string) *expandingStream {
+	return &expandingStream{source: source, name: name}
+}
+
+func (s *expandingStream) Next() (ImageRequest, error) {
+	for {
+		if s.expansion != nil {
+			if url, ok := s.expansion.next(); ok {
+				req := s.current
+				req.URL = url
+				return req, nil
+			}
+			s.expansion = nil
+		}
+
+		req, err := s.source.Next()
+		if err != nil {
+			return req, err
+		}
+
+		pattern, ok := parseBracePattern(req.URL)
+		if !ok {
+			return req, nil
+		}
+		if req.Filename != "" || req.SHA256 != "" {
+			return ImageRequest{}, &InputLineError{File: s.name, Line: lastLine(s.source), Text: req.URL,
+				Err: errors.New("a URL pattern can't have a filename or sha256")}
+		}
+		s.current = req
+		s.expansion = pattern.expand()
+	}
+}
+
+func (s *expandingStream) Close() error {
+	return s.source.Close()
+}
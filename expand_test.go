@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBracePattern_Expand(t *testing.T) {
+	tests := map[string][]string{
+		"https://cdn/x/img_{0001..0003}.jpg":  {"https://cdn/x/img_0001.jpg", "https://cdn/x/img_0002.jpg", "https://cdn/x/img_0003.jpg"},
+		"https://cdn/{8..11}.jpg":             {"https://cdn/8.jpg", "https://cdn/9.jpg", "https://cdn/10.jpg", "https://cdn/11.jpg"},
+		"https://cdn/{098..100}.jpg":          {"https://cdn/098.jpg", "https://cdn/099.jpg", "https://cdn/100.jpg"},
+		"https://cdn/{3..1}.jpg":              {"https://cdn/3.jpg", "https://cdn/2.jpg", "https://cdn/1.jpg"},
+		"https://cdn/{0..10..5}.jpg":          {"https://cdn/0.jpg", "https://cdn/5.jpg", "https://cdn/10.jpg"},
+		"https://cdn/{10..1..-4}.jpg":         {"https://cdn/10.jpg", "https://cdn/6.jpg", "https://cdn/2.jpg"},
+		"https://cdn/{-1..1}.jpg":             {"https://cdn/-1.jpg", "https://cdn/0.jpg", "https://cdn/1.jpg"},
+		"https://cdn/page{1..2}/{a,b}.png":    {"https://cdn/page1/a.png", "https://cdn/page1/b.png", "https://cdn/page2/a.png", "https://cdn/page2/b.png"},
+		"https://{a,b}.cdn/{x}/{}/{{1,2}.jpg": {"https://a.cdn/{x}/{}/{1.jpg", "https://a.cdn/{x}/{}/{2.jpg", "https://b.cdn/{x}/{}/{1.jpg", "https://b.cdn/{x}/{}/{2.jpg"},
+		"https://cdn/{a,}.jpg":                {"https://cdn/a.jpg", "https://cdn/.jpg"},
+		"https://cdn/{1..2}{1..2}.jpg":        {"https://cdn/11.jpg", "https://cdn/12.jpg", "https://cdn/21.jpg", "https://cdn/22.jpg"},
+	}
+
+	for pattern, expected := range tests {
+		parsed, ok := parseBracePattern(pattern)
+		if !assert.True(t, ok, pattern) {
+			continue
+		}
+
+		var actual []string
+		expansion := parsed.expand()
+		for {
+			url, ok := expansion.next()
+			if !ok {
+				break
+			}
+			actual = append(actual, url)
+		}
+		assert.Equal(t, expected, actual, pattern)
+	}
+}
+
+func TestParseBracePattern_NoGroups(t *testing.T) {
+	for _, s := range []string{
+		"https://cdn/img.jpg",
+		"https://cdn/{id}.jpg",
+		"https://cdn/{1..}.jpg",
+		"https://cdn/{1..5..0}.jpg",
+		"https://cdn/{1,2.jpg",
+		"https://cdn/1,2}.jpg",
+		"https://cdn/{1..9999999999999999999}.jpg",
+	} {
+		_, ok := parseBracePattern(s)
+		assert.False(t, ok, s)
+	}
+}
+
+func TestExpandingStream(t *testing.T) {
+	source := &sliceStream{requests: []ImageRequest{
+		{URL: "https://cdn/a.jpg"},
+		{URL: "https://cdn/img_{01..03}.jpg", Priority: 2, Headers: map[string]string{"Referer": "https://cdn/"}},
+		{URL: "https://cdn/b.jpg"},
+	}}
+
+	requests, err := drainStream(newExpandingStream(source, "urls.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"https://cdn/a.jpg",
+		"https://cdn/img_01.jpg",
+		"https://cdn/img_02.jpg",
+		"https://cdn/img_03.jpg",
+		"https://cdn/b.jpg",
+	}, requestURLs(requests))
+	for _, req := range requests[1:4] {
+		assert.Equal(t, 2, req.Priority)
+		assert.Equal(t, "https://cdn/", req.Headers["Referer"])
+	}
+}
+
+func TestExpandingStream_Lazy(t *testing.T) {
+	source := &sliceStream{requests: imageRequests("https://cdn/img_{1..999999999999}.jpg")}
+	stream := newExpandingStream(source, "urls.txt")
+
+	batch, err := nextBatch(stream, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://cdn/img_1.jpg", "https://cdn/img_2.jpg", "https://cdn/img_3.jpg"}, requestURLs(batch))
+}
+
+func TestFormatURLReader_ExpandBraces(t *testing.T) {
+	dir := t.TempDir()
+	manifestFile := filepath.Join(dir, "urls.jsonl")
+	assert.NoError(t, os.WriteFile(manifestFile, []byte(`{"url": "https://cdn/{a,b}.jpg"}`+"\n"+
+		`{"url": "https://cdn/{1..2}.jpg", "filename": "same.jpg"}`+"\n"+
+		`{"url": "https://cdn/?q={x,y}"}`+"\n"), 0644))
+	sitemapFile := filepath.Join(dir, "sitemap.xml")
+	assert.NoError(t, os.WriteFile(sitemapFile, []byte(imageSitemap(
+		`<url><loc>https://cdn/</loc><image:image><image:loc>https://cdn/{0..999999999999}.jpg</image:loc></image:image></url>`)), 0644))
+
+	// Off by default, the URLs are kept as they are
+	requests, err := readAllImageRequests(NewFormatURLReader(InputFormatAuto), manifestFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://cdn/{a,b}.jpg", "https://cdn/{1..2}.jpg", "https://cdn/?q={x,y}"}, requestURLs(requests))
+
+	reader := NewFormatURLReader(InputFormatAuto)
+	reader.ExpandBraces = true
+	stream, err := reader.OpenImageRequests(context.Background(), manifestFile)
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	var urls []string
+	var rejected []int
+	for {
+		req, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		var lineErr *InputLineError
+		if errors.As(err, &lineErr) {
+			rejected = append(rejected, lineErr.Line)
+			continue
+		}
+		assert.NoError(t, err)
+		urls = append(urls, req.URL)
+	}
+	assert.Equal(t, []string{"https://cdn/a.jpg", "https://cdn/b.jpg", "https://cdn/?q=x", "https://cdn/?q=y"}, urls)
+	// A pattern can't name its file
+	assert.Equal(t, []int{2}, rejected)
+
+	// Sitemaps, feeds and IIIF manifests are never expanded
+	requests, err = readAllImageRequests(reader, sitemapFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://cdn/{0..999999999999}.jpg"}, requestURLs(requests))
+}
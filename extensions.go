@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtensionPolicy is what DownloadImage does when the extension of an image
+// file doesn't tell its format. The format is sniffed from the first bytes of
+// the image, or else taken from the Content-Type of the response.
+type ExtensionPolicy int
+
+const (
+	// KeepExtension leaves file names alone, mismatches are only logged.
+	KeepExtension ExtensionPolicy = iota
+	// AddExtension gives the extension of its format to an image saved
+	// without an image extension, as the names of URLs like /image?id=123 are.
+	AddExtension
+	// FixExtension also replaces image extensions that don't match the format,
+	// like .jpg for a WebP image.
+	FixExtension
+)
+
+// Extension policies for the extension_policy key.
+const (
+	ExtensionPolicyKeep = "keep"
+	ExtensionPolicyAdd  = "add"
+	ExtensionPolicyFix  = "fix"
+)
+
+func parseExtensionPolicy(policy string) (ExtensionPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(policy)) {
+	case ExtensionPolicyKeep:
+		return KeepExtension, nil
+	case ExtensionPolicyAdd, "":
+		return AddExtension, nil
+	case ExtensionPolicyFix:
+		return FixExtension, nil
+	}
+	return 0, fmt.Errorf("unknown policy %q: must be keep, add or fix", policy)
+}
+
+// sniffLength is how much of an image is read to tell its format.
+const sniffLength = 512
+
+// imageExtensions maps the extensions of the image formats that are told
+// apart to the one files are given.
+var imageExtensions = map[string]string{
+	".jpg": ".jpg", ".jpeg": ".jpg", ".jpe": ".jpg", ".jfif": ".jpg",
+	".png":  ".png",
+	".gif":  ".gif",
+	".webp": ".webp",
+	".avif": ".avif",
+	".heic": ".heic", ".heif": ".heic",
+	".tif": ".tif", ".tiff": ".tif",
+	".bmp": ".bmp",
+	".svg": ".svg",
+}
+
+// imageFormatExtensions are the extensions of imageExtensions files are given.
+var imageFormatExtensions = []string{".jpg", ".png", ".gif", ".webp", ".avif", ".heic", ".tif", ".bmp", ".svg"}
+
+// contentTypeExtensions maps image media types to their extension.
+var contentTypeExtensions = map[string]string{
+	"image/jpeg":     ".jpg",
+	"image/pjpeg":    ".jpg",
+	"image/png":      ".png",
+	"image/gif":      ".gif",
+	"image/webp":     ".webp",
+	"image/avif":     ".avif",
+	"image/heic":     ".heic",
+	"image/heif":     ".heic",
+	"image/tiff":     ".tif",
+	"image/bmp":      ".bmp",
+	"image/x-ms-bmp": ".bmp",
+	"image/svg+xml":  ".svg",
+}
+
+// imageExtension returns the extension files of the format with extension ext
+// are given, or "" if ext isn't the extension of a known image format.
+func imageExtension(ext string) string {
+	return imageExtensions[strings.ToLower(ext)]
+}
+
+// contentTypeExtension returns the extension of the image media type of a
+// Content-Type header, or "" if it isn't a known image type.
+func contentTypeExtension(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return contentTypeExtensions[mediaType]
+}
+
+// sniffImageExtension tells the format of an image from its first bytes,
+// returning its extension or "" if the format isn't known.
+func sniffImageExtension(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return ".jpg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return ".png"
+	case bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a")):
+		return ".gif"
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return ".webp"
+	case len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")):
+		return sniffISOBrand(data)
+	case bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*")):
+		return ".tif"
+	case len(data) >= 14 && bytes.HasPrefix(data, []byte("BM")):
+		return ".bmp"
+	case isSVG(data):
+		return ".svg"
+	}
+	return ""
+}
+
+// sniffISOBrand tells AVIF from HEIC by the brands of the ftyp box that starts
+// an ISO base media file: the major brand, and the compatible ones after the
+// minor version.
+func sniffISOBrand(data []byte) string {
+	size := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if size < 16 || size > len(data) {
+		size = len(data)
+	}
+
+	brands := make(map[string]bool)
+	brands[string(data[8:12])] = true
+	for i := 16; i+4 <= size; i += 4 {
+		brands[string(data[i:i+4])] = true
+	}
+
+	switch {
+	case brands["avif"] || brands["avis"]:
+		return ".avif"
+	case brands["heic"] || brands["heix"] || brands["heim"] || brands["heis"] ||
+		brands["hevc"] || brands["hevx"] || brands["mif1"] || brands["msf1"]:
+		return ".heic"
+	}
+	// Some other ISO file, like an MP4 video
+	return ""
+}
+
+// isSVG tells whether data starts an SVG document: an svg element, after an
+// optional XML declaration, comments and doctype.
+func isSVG(data []byte) bool {
+	text := bytes.ToLower(bytes.TrimLeft(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), " \t\r\n"))
+	if !bytes.HasPrefix(text, []byte("<")) {
+		return false
+	}
+	start := bytes.Index(text, []byte("<svg"))
+	return start >= 0 && !bytes.Contains(text[:start], []byte("<html"))
+}
+
+// fileImageExtension sniffs the format of the image at filePath, falling back
+// on the Content-Type of the response. It logs a Content-Type that doesn't
+// match the content.
+func fileImageExtension(filePath string, header http.Header, url string) string {
+	var sniffed string
+	if file, err := os.Open(filePath); err == nil {
+		data := make([]byte, sniffLength)
+		n, _ := io.ReadFull(file, data)
+		file.Close()
+		sniffed = sniffImageExtension(data[:n])
+	}
+
+	contentType := header.Get("Content-Type")
+	served := contentTypeExtension(contentType)
+	if sniffed == "" {
+		return served
+	}
+	if served != "" && served != sniffed {
+		log.Printf("%s is served as %s, but its content is %s", url, contentType, strings.TrimPrefix(sniffed, "."))
+	}
+	return sniffed
+}
+
+// imagePath returns the path an image downloaded to downloaded is saved as,
+// filePath with the extension of its format where the policy asks for it. It
+// logs an extension that doesn't match the format.
+func (p ExtensionPolicy) imagePath(filePath, downloaded string, header http.Header, url string) string {
+	ext := fileImageExtension(downloaded, header, url)
+	path := p.withImageExtension(filePath, ext)
+	if current := imageExtension(filepath.Ext(path)); current != "" && ext != "" && current != ext {
+		log.Printf("%s is saved as %s, but its content is %s", url, filepath.Base(path), strings.TrimPrefix(ext, "."))
+	}
+	return path
+}
+
+// withImageExtension returns filePath with the extension ext, an extension of
+// imageExtensions, where the policy asks for it.
+func (p ExtensionPolicy) withImageExtension(filePath, ext string) string {
+	current := imageExtension(filepath.Ext(filePath))
+	switch {
+	case ext == "" || current == ext || p == KeepExtension:
+		return filePath
+	case current == "":
+		return filePath + ext
+	case p == FixExtension:
+		return strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ext
+	}
+	return filePath
+}
+
+// candidatePaths returns filePath and the paths the policy could have given
+// to an image downloaded to it, where an earlier run may have saved it.
+func (p ExtensionPolicy) candidatePaths(filePath string) []string {
+	paths := []string{filePath}
+	if p == KeepExtension {
+		return paths
+	}
+
+	for _, ext := range imageFormatExtensions {
+		if path := p.withImageExtension(filePath, ext); path != filePath {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSniffImageExtension(t *testing.T) {
+	for contents, want := range map[string]string{
+		"\xff\xd8\xff\xe0\x00\x10JFIF\x00":                          ".jpg",
+		"\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR":                       ".png",
+		"GIF89a\x01\x00\x01\x00":                                    ".gif",
+		"RIFF\x24\x00\x00\x00WEBPVP8 ":                              ".webp",
+		"\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf":      ".avif",
+		"\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1avif":          ".avif",
+		"\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic":          ".heic",
+		"\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2":          "",
+		"II*\x00\x08\x00\x00\x00":                                   ".tif",
+		"MM\x00*\x00\x00\x00\x08":                                   ".tif",
+		"BM\x36\x00\x0c\x00\x00\x00\x00\x00\x36\x00\x00\x00":        ".bmp",
+		"\xef\xbb\xbf<?xml version=\"1.0\"?>\n<!-- logo -->\n<svg>": ".svg",
+		"<!DOCTYPE html><html><body><svg></svg></body></html>":      "",
+		"<html><body>Not found</body></html>":                       "",
+		"BM":                                                        "",
+		"":                                                          "",
+	} {
+		assert.Equal(t, want, sniffImageExtension([]byte(contents)), "%q", contents)
+	}
+}
+
+func TestContentTypeExtension(t *testing.T) {
+	assert.Equal(t, ".jpg", contentTypeExtension("image/jpeg"))
+	assert.Equal(t, ".svg", contentTypeExtension("Image/SVG+XML; charset=utf-8"))
+	assert.Equal(t, "", contentTypeExtension("application/octet-stream"))
+	assert.Equal(t, "", contentTypeExtension(""))
+}
+
+func TestExtensionPolicy_WithImageExtension(t *testing.T) {
+	tests := []struct {
+		policy   ExtensionPolicy
+		filePath string
+		ext      string
+		want     string
+	}{
+		{KeepExtension, "photo", ".jpg", "photo"},
+		{AddExtension, "photo", ".jpg", "photo.jpg"},
+		{AddExtension, "img.php", ".png", "img.php.png"},
+		{AddExtension, "a.jpg", ".webp", "a.jpg"},
+		{AddExtension, "a.JPEG", ".jpg", "a.JPEG"},
+		{AddExtension, "photo", "", "photo"},
+		{FixExtension, "a.jpg", ".webp", "a.webp"},
+		{FixExtension, "a.tiff", ".tif", "a.tiff"},
+		{FixExtension, "photo", ".gif", "photo.gif"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.policy.withImageExtension(tt.filePath, tt.ext), "%v %s %s", tt.policy, tt.filePath, tt.ext)
+	}
+}
+
+func TestExtensionPolicy_CandidatePaths(t *testing.T) {
+	assert.Equal(t, []string{"a.jpg"}, KeepExtension.candidatePaths("a.jpg"))
+	assert.Equal(t, []string{"a.jpg"}, AddExtension.candidatePaths("a.jpg"))
+	assert.Equal(t, []string{"a.jpg", "a.png", "a.gif", "a.webp", "a.avif", "a.heic", "a.tif", "a.bmp", "a.svg"},
+		FixExtension.candidatePaths("a.jpg"))
+	assert.Len(t, AddExtension.candidatePaths("photo"), 10)
+}
+
+func TestParseExtensionPolicy(t *testing.T) {
+	for value, want := range map[string]ExtensionPolicy{"keep": KeepExtension, "Add": AddExtension, "": AddExtension, "fix": FixExtension} {
+		policy, err := parseExtensionPolicy(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, policy, value)
+	}
+
+	_, err := parseExtensionPolicy("rename")
+	assert.Error(t, err)
+}
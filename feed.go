@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FeedURLReader reads the image URLs of RSS 2.0 and Atom feeds and of JSON
+// Feeds: the enclosures and Media RSS content and thumbnails of RSS items,
+// the enclosure and image links and Media RSS elements of Atom entries, and
+// the attachments and images of JSON Feed items.
+type FeedURLReader struct {
+	HTTPClient  HTTPClient
+	RetryPolicy *RetryPolicy
+	// MIMETypes are the media types read, patterns such as image/* or
+	// image/jpeg. Every type is read if empty.
+	MIMETypes []string
+	// State remembers the newest item of each feed so that only the items
+	// after it are read the next time, unless nil.
+	State *FeedState
+}
+
+func NewFeedURLReader(httpClient HTTPClient) *FeedURLReader {
+	return &FeedURLReader{HTTPClient: httpClient, MIMETypes: []string{"image/*"}}
+}
+
+func (r *FeedURLReader) OpenImageRequests(ctx context.Context, filePath string) (ImageRequestStream, error) {
+	doc, err := openDocument(ctx, r.HTTPClient, r.RetryPolicy, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open feed: %w", err)
+	}
+
+	return r.readDocument(filePath, doc)
+}
+
+// readDocument reads an opened feed. A JSON Feed is read at once, an XML one
+// an item at a time.
+func (r *FeedURLReader) readDocument(location string, doc *document) (ImageRequestStream, error) {
+	stream := &feedStream{reader: r, location: location, doc: doc}
+	if isRemoteInput(location) {
+		stream.base, _ = url.Parse(location)
+	}
+	if r.State != nil {
+		stream.lastSeen = r.State.LastSeen(location)
+	}
+
+	if doc.isJSON() {
+		if err := stream.readJSONFeed(); err != nil {
+			doc.Close()
+			return nil, err
+		}
+		return stream, nil
+	}
+	stream.decoder = xml.NewDecoder(doc)
+
+	return stream, nil
+}
+
+// feedImage is an image URL of a feed item with the media type the feed gives
+// for it. Image says whether the feed tells it is an image without its type.
+type feedImage struct {
+	url       string
+	mediaType string
+	image     bool
+}
+
+// feedItem is an RSS item or Atom entry.
+type feedItem struct {
+	GUID       string     `xml:"guid"`
+	ID         string     `xml:"id"`
+	Links      []feedLink `xml:"link"`
+	Enclosures []struct {
+		URL  string `xml:"url,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"enclosure"`
+	mediaElements
+	Groups []mediaElements `xml:"http://search.yahoo.com/mrss/ group"`
+}
+
+// feedLink is an RSS link, which holds the URL as text, or an Atom link.
+type feedLink struct {
+	Text string `xml:",chardata"`
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// mediaElements are the Media RSS elements of an item or media:group.
+type mediaElements struct {
+	Contents []struct {
+		URL    string `xml:"url,attr"`
+		Type   string `xml:"type,attr"`
+		Medium string `xml:"medium,attr"`
+	} `xml:"http://search.yahoo.com/mrss/ content"`
+	Thumbnails []struct {
+		URL string `xml:"url,attr"`
+	} `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+}
+
+func (m *mediaElements) images() []feedImage {
+	var images []feedImage
+	for _, content := range m.Contents {
+		images = append(images, feedImage{url: content.URL, mediaType: content.Type, image: content.Medium == "image"})
+	}
+	for _, thumbnail := range m.Thumbnails {
+		images = append(images, feedImage{url: thumbnail.URL, image: true})
+	}
+	return images
+}
+
+// key identifies the item across runs: its guid or id, or else its link.
+func (item *feedItem) key() string {
+	for _, key := range []string{item.GUID, item.ID} {
+		if key = strings.TrimSpace(key); key != "" {
+			return key
+		}
+	}
+	for _, link := range item.Links {
+		if link.Rel == "" || link.Rel == "alternate" {
+			if key := strings.TrimSpace(link.Text + link.Href); key != "" {
+				return key
+			}
+		}
+	}
+	return ""
+}
+
+func (item *feedItem) images() []feedImage {
+	var images []feedImage
+	for _, enclosure := range item.Enclosures {
+		images = append(images, feedImage{url: enclosure.URL, mediaType: enclosure.Type})
+	}
+	for _, link := range item.Links {
+		if link.Href != "" && (link.Rel == "enclosure" || strings.HasPrefix(strings.ToLower(link.Type), "image/")) {
+			images = append(images, feedImage{url: link.Href, mediaType: link.Type})
+		}
+	}
+	images = append(images, item.mediaElements.images()...)
+	for _, group := range item.Groups {
+		images = append(images, group.images()...)
+	}
+	return images
+}
+
+// jsonFeed is the part of a JSON Feed (https://jsonfeed.org) that is read.
+type jsonFeed struct {
+	Items []struct {
+		ID          json.RawMessage `json:"id"`
+		URL         string          `json:"url"`
+		Image       string          `json:"image"`
+		BannerImage string          `json:"banner_image"`
+		Attachments []struct {
+			URL      string `json:"url"`
+			MIMEType string `json:"mime_type"`
+		} `json:"attachments"`
+	} `json:"items"`
+}
+
+// feedStream yields the images of the items of a feed, newest first, up to
+// the newest item of the last run.
+type feedStream struct {
+	reader   *FeedURLReader
+	location string
+	base     *url.URL
+	doc      *document
+	lastSeen string
+
+	// decoder reads an XML feed, a JSON Feed is read into items up front
+	decoder *xml.Decoder
+	items   []feedStreamItem
+	marked  bool
+	done    bool
+	results []requestResult
+}
+
+// feedStreamItem is the key and the images of an item.
+type feedStreamItem struct {
+	key    string
+	images []feedImage
+}
+
+func (s *feedStream) readJSONFeed() error {
+	var feed jsonFeed
+	if err := json.NewDecoder(s.doc).Decode(&feed); err != nil {
+		return fmt.Errorf("failed to parse feed %s: %w", s.doc.name, err)
+	}
+
+	for _, item := range feed.Items {
+		// Ids are strings, but some feeds use numbers
+		key := strings.Trim(string(item.ID), `"`)
+		if key == "" || key == "null" {
+			key = item.URL
+		}
+
+		var images []feedImage
+		for _, attachment := range item.Attachments {
+			images = append(images, feedImage{url: attachment.URL, mediaType: attachment.MIMEType})
+		}
+		for _, image := range []string{item.Image, item.BannerImage} {
+			if image != "" {
+				images = append(images, feedImage{url: image, image: true})
+			}
+		}
+		s.items = append(s.items, feedStreamItem{key: key, images: images})
+	}
+
+	return nil
+}
+
+func (s *feedStream) Next() (ImageRequest, error) {
+	for len(s.results) == 0 {
+		if s.done {
+			return ImageRequest{}, io.EOF
+		}
+
+		item, line, err := s.nextItem()
+		if err == io.EOF {
+			s.done = true
+			continue
+		}
+		if err != nil {
+			s.done = true
+			return ImageRequest{}, err
+		}
+
+		if item.key != "" {
+			if item.key == s.lastSeen {
+				s.done = true
+				continue
+			}
+			// Items come newest first, the first one is where the next run stops
+			if !s.marked && s.reader.State != nil {
+				s.reader.State.MarkSeen(s.location, item.key)
+			}
+			s.marked = true
+		}
+
+		for _, image := range item.images {
+			s.addImage(image, line)
+		}
+	}
+
+	result := s.results[0]
+	s.results = s.results[1:]
+	return result.req, result.err
+}
+
+// nextItem returns the next item of the feed, with its line in an XML feed.
+func (s *feedStream) nextItem() (feedStreamItem, int, error) {
+	if s.decoder == nil {
+		if len(s.items) == 0 {
+			return feedStreamItem{}, 0, io.EOF
+		}
+		item := s.items[0]
+		s.items = s.items[1:]
+		return item, 0, nil
+	}
+
+	for {
+		token, err := s.decoder.Token()
+		if err == io.EOF {
+			return feedStreamItem{}, 0, io.EOF
+		}
+		if err != nil {
+			return feedStreamItem{}, 0, fmt.Errorf("failed to parse feed %s: %w", s.doc.name, err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || (start.Name.Local != "item" && start.Name.Local != "entry") {
+			continue
+		}
+
+		line, _ := s.decoder.InputPos()
+		var item feedItem
+		if err := s.decoder.DecodeElement(&item, &start); err != nil {
+			return feedStreamItem{}, 0, fmt.Errorf("failed to parse feed %s: %w", s.doc.name, err)
+		}
+		return feedStreamItem{key: item.key(), images: item.images()}, line, nil
+	}
+}
+
+// addImage adds the request for an image of an item to the results if it has
+// one of the media types read. Relative URLs are resolved against the feed.
+func (s *feedStream) addImage(image feedImage, line int) {
+	imageURL := strings.TrimSpace(image.url)
+	if s.base != nil {
+		if resolved, err := s.base.Parse(imageURL); err == nil {
+			imageURL = resolved.String()
+		}
+	}
+	if !s.reader.accepts(image, imageURL) {
+		return
+	}
+
+	if err := validateImageURL(imageURL); err != nil {
+		lineErr := &InputLineError{File: s.doc.name, Line: line, Text: imageURL, Err: err}
+		s.results = append(s.results, requestResult{err: lineErr})
+		return
+	}
+	s.results = append(s.results, requestResult{req: ImageRequest{URL: imageURL}})
+}
+
+func (s *feedStream) Close() error {
+	return s.doc.Close()
+}
+
+// accepts reports whether the image has one of the media types read. Without
+// a type in the feed, it is guessed from the URL extension, and an image whose
+// type is still unknown has any image type.
+func (r *FeedURLReader) accepts(image feedImage, imageURL string) bool {
+	if len(r.MIMETypes) == 0 {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(image.mediaType)
+	if mediaType == "" {
+		if u, err := url.Parse(imageURL); err == nil {
+			mediaType, _, _ = mime.ParseMediaType(mime.TypeByExtension(path.Ext(u.Path)))
+		}
+	}
+
+	for _, pattern := range r.MIMETypes {
+		pattern = strings.ToLower(pattern)
+		if mediaType == "" {
+			if image.image && (strings.HasPrefix(pattern, "image/") || strings.HasPrefix(pattern, "*/")) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validMIMETypePatterns checks the patterns of the feed_mime_types key.
+func validMIMETypePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || strings.Count(pattern, "/") != 1 {
+			return fmt.Errorf("invalid media type pattern %q: expected a pattern such as image/* or image/jpeg", pattern)
+		}
+	}
+	return nil
+}
+
+// FeedState is the newest item seen of each feed, kept in a JSON file between
+// runs. The items read in a run are only recorded when Save is called, after
+// their images were downloaded.
+type FeedState struct {
+	path string
+
+	mu       sync.Mutex
+	lastSeen map[string]string
+	updates  map[string]string
+}
+
+// LoadFeedState loads the state from path, a missing file being an empty state.
+func LoadFeedState(path string) (*FeedState, error) {
+	state := &FeedState{path: path, lastSeen: make(map[string]string), updates: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state.lastSeen); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	return state, nil
+}
+
+// LastSeen returns the key of the newest item of the feed read before.
+func (s *FeedState) LastSeen(feed string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSeen[feed]
+}
+
+// MarkSeen records key as the newest item of the feed once the state is saved.
+func (s *FeedState) MarkSeen(feed, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates[feed] = key
+}
+
+// Save records the newest items read in this run in the state file.
+func (s *FeedState) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.updates) == 0 {
+		return nil
+	}
+
+	for feed, key := range s.updates {
+		s.lastSeen[feed] = key
+	}
+	data, err := json.MarshalIndent(s.lastSeen, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the file at once so an interrupted save keeps the old state
+	file, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", s.path, err)
+	}
+
+	s.updates = make(map[string]string)
+	return nil
+}
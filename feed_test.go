@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const rssFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/">
+  <channel>
+    <title>Photos</title>
+    <link>https://example.com/</link>
+    <item>
+      <guid>photo-3</guid>
+      <enclosure url="https://example.com/3.jpg" length="1000" type="image/jpeg"/>
+      <enclosure url="https://example.com/3.mp3" length="1000" type="audio/mpeg"/>
+    </item>
+    <item>
+      <guid isPermaLink="false">photo-2</guid>
+      <media:content url="https://example.com/2.webp" medium="image"/>
+      <media:content url="https://example.com/2.mp4" type="video/mp4"/>
+      <media:group>
+        <media:thumbnail url="https://example.com/2_thumb"/>
+      </media:group>
+    </item>
+    <item>
+      <link>https://example.com/posts/1</link>
+      <media:thumbnail url="https://example.com/1.png"/>
+    </item>
+  </channel>
+</rss>`
+
+func TestFeedURLReader_RSS(t *testing.T) {
+	feed := createTempFile(t, []byte(rssFeed))
+	defer os.Remove(feed)
+
+	requests, err := readAllImageRequests(NewFeedURLReader(NewStandardHTTPClient()), feed)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"https://example.com/3.jpg",
+		"https://example.com/2.webp",
+		"https://example.com/2_thumb",
+		"https://example.com/1.png",
+	}, requestURLs(requests))
+}
+
+func TestFeedURLReader_Atom(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <link rel="self" href="/photos.atom"/>
+  <entry>
+    <id>tag:example.com,2024:2</id>
+    <link rel="alternate" type="text/html" href="/photos/2"/>
+    <link rel="enclosure" type="image/png" href="/photos/2.png"/>
+    <content type="html">&lt;img src="/photos/2_small.png"&gt;</content>
+  </entry>
+  <entry>
+    <id>tag:example.com,2024:1</id>
+    <link rel="alternate" type="image/jpeg" href="https://cdn.example.com/1.jpg"/>
+  </entry>
+</feed>`))
+	}))
+	defer server.Close()
+
+	requests, err := readAllImageRequests(NewFeedURLReader(NewStandardHTTPClient()), server.URL+"/feeds/photos.atom")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{server.URL + "/photos/2.png", "https://cdn.example.com/1.jpg"}, requestURLs(requests))
+}
+
+func TestFeedURLReader_JSONFeed(t *testing.T) {
+	feed := createTempFile(t, []byte(`{
+  "version": "https://jsonfeed.org/version/1.1",
+  "title": "Photos",
+  "items": [
+    {"id": 2, "image": "https://example.com/2.jpg", "attachments": [
+      {"url": "https://example.com/2.gif", "mime_type": "image/gif"},
+      {"url": "https://example.com/2.m4a", "mime_type": "audio/x-m4a"}
+    ]},
+    {"id": "1", "banner_image": "not a url"}
+  ]
+}`))
+	defer os.Remove(feed)
+
+	reader := NewFeedURLReader(NewStandardHTTPClient())
+	stream, err := reader.OpenImageRequests(context.Background(), feed)
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	requests, err := drainStream(stream)
+	assert.Equal(t, []string{"https://example.com/2.gif", "https://example.com/2.jpg"}, requestURLs(requests))
+	assert.EqualError(t, err, feed+`: invalid URL "not a url": the scheme must be http or https`)
+}
+
+func TestFeedURLReader_State(t *testing.T) {
+	dir := t.TempDir()
+	feed := filepath.Join(dir, "photos.rss")
+	assert.NoError(t, os.WriteFile(feed, []byte(rssFeed), 0644))
+	stateFile := filepath.Join(dir, "feed_state.json")
+
+	state, err := LoadFeedState(stateFile)
+	assert.NoError(t, err)
+	reader := NewFeedURLReader(NewStandardHTTPClient())
+	reader.State = state
+	requests, err := readAllImageRequests(reader, feed)
+	assert.NoError(t, err)
+	assert.Len(t, requests, 4)
+
+	// Nothing is remembered until the state is saved
+	assert.Equal(t, "", state.LastSeen(feed))
+	assert.NoError(t, state.Save())
+	assert.Equal(t, "photo-3", state.LastSeen(feed))
+
+	// A new item is published
+	updated := strings.Replace(rssFeed, "<item>", `<item><guid>photo-4</guid><enclosure url="https://example.com/4.jpg" type="image/jpeg"/></item>
+    <item>`, 1)
+	assert.NoError(t, os.WriteFile(feed, []byte(updated), 0644))
+
+	state, err = LoadFeedState(stateFile)
+	assert.NoError(t, err)
+	reader.State = state
+	requests, err = readAllImageRequests(reader, feed)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/4.jpg"}, requestURLs(requests))
+	assert.NoError(t, state.Save())
+
+	contents, err := os.ReadFile(stateFile)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"`+feed+`": "photo-4"}`, string(contents))
+}
+
+func TestDownloadImages_FeedStateAfterFailures(t *testing.T) {
+	dir := t.TempDir()
+	feed := filepath.Join(dir, "photos.rss")
+	assert.NoError(t, os.WriteFile(feed, []byte(rssFeed), 0644))
+	stateFile := filepath.Join(dir, "feed_state.json")
+
+	for _, failing := range []bool{true, false} {
+		state, err := LoadFeedState(stateFile)
+		assert.NoError(t, err)
+		reader := NewFormatURLReader(InputFormatFeed)
+		reader.Feed = NewFeedURLReader(NewStandardHTTPClient())
+		reader.Feed.State = state
+
+		downloader := &blockingDownloader{release: make(chan struct{})}
+		close(downloader.release)
+		if failing {
+			downloader.fail = map[string]bool{"https://example.com/2.webp": true}
+		}
+		helper := NewHelper(downloader, reader, &stubImageSizeChecker{}, NewDefaultFileChecker(),
+			nil, NewDefaultWaitTimeGenerator(), nil, nil)
+		helper.FeedState = state
+		config := &Config{
+			ImageURLFiles:     []string{feed},
+			DownloadDirectory: filepath.Join(dir, "images"),
+			BatchSize:         10,
+			MaxImageSize:      -1,
+			FailedURLFile:     filepath.Join(dir, "failed_urls.txt"),
+		}
+		assert.NoError(t, helper.DownloadImages(context.Background(), config))
+
+		// The items are read again until all their images are downloaded
+		if failing {
+			_, err = os.Stat(stateFile)
+			assert.True(t, os.IsNotExist(err), "expected no feed state after a failed download")
+			continue
+		}
+		contents, err := os.ReadFile(stateFile)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"`+feed+`": "photo-3"}`, string(contents))
+	}
+}
+
+func TestFeedURLReader_Accepts(t *testing.T) {
+	reader := &FeedURLReader{MIMETypes: []string{"image/jpeg", "image/png"}}
+
+	assert.True(t, reader.accepts(feedImage{mediaType: "image/JPEG; q=1"}, "https://example.com/a"))
+	assert.False(t, reader.accepts(feedImage{mediaType: "image/gif"}, "https://example.com/a.jpg"))
+	assert.True(t, reader.accepts(feedImage{}, "https://example.com/a.png?w=100"))
+	assert.False(t, reader.accepts(feedImage{}, "https://example.com/a.gif"))
+	assert.True(t, reader.accepts(feedImage{image: true}, "https://example.com/a"))
+	assert.False(t, reader.accepts(feedImage{}, "https://example.com/a"))
+
+	reader.MIMETypes = nil
+	assert.True(t, reader.accepts(feedImage{mediaType: "video/mp4"}, "https://example.com/a.mp4"))
+}
+
+func TestLoadFeedState_Invalid(t *testing.T) {
+	stateFile := createTempFile(t, []byte("not json"))
+	defer os.Remove(stateFile)
+
+	_, err := LoadFeedState(stateFile)
+	assert.ErrorContains(t, err, "failed to parse "+stateFile)
+}
+
+func TestValidMIMETypePatterns(t *testing.T) {
+	assert.NoError(t, validMIMETypePatterns([]string{"image/*", "image/jpeg", "*/*"}))
+	assert.Error(t, validMIMETypePatterns([]string{"image"}))
+	assert.Error(t, validMIMETypePatterns([]string{"image/[a"}))
+}
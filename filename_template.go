@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FilenameTemplate builds the path an image is saved under, relative to the
+// download directory, from fields like {host}, {sha256:8} or {index:06}. See
+// templateFields for the fields. Slashes in the template, and in the path
+// fields, separate directories.
+type FilenameTemplate struct {
+	text  string
+	parts []templatePart
+}
+
+// templatePart is a literal text, or a field with its argument.
+type templatePart struct {
+	literal string
+	field   string
+	arg     string
+}
+
+// templateFields are the known fields, and whether they take an argument.
+// Arguments are optional for index and sha256, the rest of those taking one
+// require it.
+var templateFields = map[string]bool{
+	// The URL
+	"host":      false,
+	"path":      false,
+	"path_dir":  false,
+	"basename":  false,
+	"ext":       false,
+	"url_query": false,
+	// The input record
+	"name":   false,
+	"subdir": false,
+	"index":  true,
+	"meta":   true,
+	// The download
+	"date":          true,
+	"last_modified": true,
+	"header":        true,
+	"sha256":        true,
+}
+
+// pathFields are the fields whose slashes are kept as directories.
+var pathFields = map[string]bool{"path": true, "path_dir": true, "subdir": true, "date": true, "last_modified": true}
+
+// ParseFilenameTemplate parses a filename_template setting. Braces are written
+// {{ and }} outside of fields.
+func ParseFilenameTemplate(text string) (*FilenameTemplate, error) {
+	t := &FilenameTemplate{text: text}
+	var literal strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch {
+		case strings.HasPrefix(text[i:], "{{") || strings.HasPrefix(text[i:], "}}"):
+			literal.WriteByte(text[i])
+			i++
+		case text[i] == '}':
+			return nil, fmt.Errorf("unexpected } at position %d", i+1)
+		case text[i] == '{':
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed { at position %d", i+1)
+			}
+			part, err := parseTemplateField(text[i+1 : i+end])
+			if err != nil {
+				return nil, err
+			}
+			if literal.Len() > 0 {
+				t.parts = append(t.parts, templatePart{literal: literal.String()})
+				literal.Reset()
+			}
+			t.parts = append(t.parts, part)
+			i += end
+		default:
+			literal.WriteByte(text[i])
+		}
+	}
+	if literal.Len() > 0 {
+		t.parts = append(t.parts, templatePart{literal: literal.String()})
+	}
+
+	if len(t.parts) == 0 {
+		return nil, fmt.Errorf("empty template")
+	}
+	return t, nil
+}
+
+func parseTemplateField(text string) (templatePart, error) {
+	field, arg, hasArg := strings.Cut(text, ":")
+	takesArg, ok := templateFields[field]
+	if !ok {
+		return templatePart{}, fmt.Errorf("unknown field {%s}", text)
+	}
+	if hasArg && !takesArg {
+		return templatePart{}, fmt.Errorf("field {%s} takes no argument", field)
+	}
+
+	part := templatePart{field: field, arg: arg}
+	switch field {
+	case "index":
+		if hasArg {
+			if width, err := strconv.Atoi(arg); err != nil || width < 1 || width > 20 {
+				return templatePart{}, fmt.Errorf("invalid width in {%s}: expected a number of digits such as 06", text)
+			}
+		}
+	case "sha256":
+		if hasArg {
+			if length, err := strconv.Atoi(arg); err != nil || length < 1 || length > 64 {
+				return templatePart{}, fmt.Errorf("invalid length in {%s}: expected 1 to 64", text)
+			}
+		}
+	default:
+		if takesArg && arg == "" {
+			return templatePart{}, fmt.Errorf("field {%s} needs an argument, as in {%s:...}", field, field)
+		}
+	}
+	return part, nil
+}
+
+// String returns the template as it was written.
+func (t *FilenameTemplate) String() string {
+	return t.text
+}
+
+// NeedsResponse tells whether the template uses fields of the response or the
+// content, so the path is only known once the image has been downloaded.
+func (t *FilenameTemplate) NeedsResponse() bool {
+	for _, part := range t.parts {
+		switch part.field {
+		case "last_modified", "header", "sha256":
+			return true
+		}
+	}
+	return false
+}
+
+// templateValues are what the fields of a template are filled from.
+type templateValues struct {
+	req ImageRequest
+	// start is when the download started, for {date}.
+	start time.Time
+	// header is the response header, and file the downloaded image, for the
+	// fields of NeedsResponse.
+	header http.Header
+	file   string
+	digest string
+}
+
+// Render fills in the template, returning a slash separated path relative to
+// the download directory. Every element of it is made a safe file name, and
+// empty elements are dropped.
+func (t *FilenameTemplate) Render(values templateValues) (string, error) {
+	var rendered strings.Builder
+	for _, part := range t.parts {
+		if part.field == "" {
+			rendered.WriteString(part.literal)
+			continue
+		}
+
+		value, err := values.field(part)
+		if err != nil {
+			return "", fmt.Errorf("failed to fill in {%s}: %v", part.field, err)
+		}
+		if pathFields[part.field] {
+			value = strings.ReplaceAll(value, "\\", "/")
+		} else {
+			value = strings.NewReplacer("/", "_", "\\", "_").Replace(value)
+		}
+		rendered.WriteString(value)
+	}
+
+	var elements []string
+	for _, element := range strings.Split(rendered.String(), "/") {
+		if element = sanitizeFileName(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	if len(elements) == 0 {
+		return "", fmt.Errorf("filename_template %q gives an empty name for %s", t.text, values.req.URL)
+	}
+	return path.Join(elements...), nil
+}
+
+func (v *templateValues) field(part templatePart) (string, error) {
+	switch part.field {
+	case "host", "path", "path_dir", "url_query":
+		parsed, err := url.Parse(v.req.URL)
+		if err != nil {
+			return "", err
+		}
+		switch part.field {
+		case "host":
+			return parsed.Hostname(), nil
+		case "path":
+			return strings.Trim(parsed.Path, "/"), nil
+		case "path_dir":
+			dir := path.Dir(strings.Trim(parsed.Path, "/"))
+			if dir == "." {
+				return "", nil
+			}
+			return dir, nil
+		default:
+			return parsed.RawQuery, nil
+		}
+	case "basename", "ext":
+		name := urlFileName(v.req.URL)
+		ext := path.Ext(name)
+		if part.field == "ext" {
+			return strings.TrimPrefix(ext, "."), nil
+		}
+		return strings.TrimSuffix(name, ext), nil
+	case "name":
+		if v.req.Filename != "" {
+			return v.req.Filename, nil
+		}
+		return urlFileName(v.req.URL), nil
+	case "subdir":
+		return v.req.Subdir, nil
+	case "index":
+		if part.arg == "" {
+			return strconv.Itoa(v.req.Index), nil
+		}
+		width, _ := strconv.Atoi(part.arg)
+		return fmt.Sprintf("%0*d", width, v.req.Index), nil
+	case "meta":
+		return v.req.Metadata[part.arg], nil
+	case "date":
+		return v.start.Format(part.arg), nil
+	case "last_modified":
+		modified, err := http.ParseTime(v.header.Get("Last-Modified"))
+		if err != nil {
+			// Not every server tells, fall back on the download date
+			modified = v.start
+		}
+		return modified.UTC().Format(part.arg), nil
+	case "header":
+		return v.header.Get(part.arg), nil
+	case "sha256":
+		if v.digest == "" {
+			digest, err := fileSHA256(v.file)
+			if err != nil {
+				return "", err
+			}
+			v.digest = digest
+		}
+		if part.arg == "" {
+			return v.digest, nil
+		}
+		length, _ := strconv.Atoi(part.arg)
+		return v.digest[:length], nil
+	}
+	return "", fmt.Errorf("unknown field")
+}
+
+// fileSHA256 returns the hex SHA-256 digest of the file.
+func fileSHA256(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilenameTemplate_Render(t *testing.T) {
+	req := ImageRequest{
+		URL:      "https://cdn.example.com/photos/2024/caf%C3%A9.jpg?w=800",
+		Filename: "cover.jpg",
+		Subdir:   "books/42",
+		Index:    12,
+		Metadata: map[string]string{"isbn": "9780306406157", "title": "A/B"},
+	}
+	values := templateValues{req: req, start: time.Date(2024, 5, 2, 10, 30, 0, 0, time.UTC)}
+
+	for text, want := range map[string]string{
+		"{host}/{path_dir}/{basename}.{ext}":     "cdn.example.com/photos/2024/café.jpg",
+		"{path}":                                 "photos/2024/café.jpg",
+		"{subdir}/{name}":                        "books/42/cover.jpg",
+		"{date:2006/01/02}/{index:06}.{ext}":     "2024/05/02/000012.jpg",
+		"{index}_{meta:isbn}_{meta:title}.{ext}": "12_9780306406157_A_B.jpg",
+		"{meta:missing}/{basename}_{url_query}":  "café_w=800",
+		"{{{index}}}.jpg":                        "{12}.jpg",
+		"../{basename}.{ext}":                    "café.jpg",
+		"{date:15:04}.{ext}":                     "10_30.jpg",
+	} {
+		template, err := ParseFilenameTemplate(text)
+		if assert.NoError(t, err, text) {
+			assert.False(t, template.NeedsResponse(), text)
+			got, err := template.Render(values)
+			assert.NoError(t, err, text)
+			assert.Equal(t, want, got, text)
+		}
+	}
+
+	template, err := ParseFilenameTemplate("{meta:missing}")
+	assert.NoError(t, err)
+	_, err = template.Render(values)
+	assert.ErrorContains(t, err, "gives an empty name")
+}
+
+func TestFilenameTemplate_RenderResponse(t *testing.T) {
+	file := createTempFile(t, []byte("hello"))
+	defer os.Remove(file)
+
+	header := http.Header{}
+	header.Set("Content-Type", "image/jpeg")
+	header.Set("Last-Modified", "Wed, 01 May 2024 22:00:00 GMT")
+	values := templateValues{
+		req:    ImageRequest{URL: "https://example.com/image"},
+		start:  time.Date(2024, 5, 2, 10, 30, 0, 0, time.UTC),
+		header: header,
+		file:   file,
+	}
+
+	template, err := ParseFilenameTemplate("{last_modified:2006-01-02}/{header:Content-Type}/{sha256:8}{sha256}")
+	assert.NoError(t, err)
+	assert.True(t, template.NeedsResponse())
+	got, err := template.Render(values)
+	assert.NoError(t, err)
+	// The SHA-256 digest of "hello" starts with 2cf24dba
+	assert.Equal(t, "2024-05-01/image_jpeg/2cf24dba2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", got)
+
+	// Without a Last-Modified header the download date is used
+	values.header = http.Header{}
+	template, err = ParseFilenameTemplate("{last_modified:2006-01-02}")
+	assert.NoError(t, err)
+	got, err = template.Render(values)
+	assert.NoError(t, err)
+	assert.Equal(t, "2024-05-02", got)
+}
+
+func TestParseFilenameTemplate_Errors(t *testing.T) {
+	for text, want := range map[string]string{
+		"":                   "empty template",
+		"{size}":             "unknown field {size}",
+		"{host:x}":           "takes no argument",
+		"{meta}":             "needs an argument",
+		"{date:}":            "needs an argument",
+		"{index:abc}":        "invalid width",
+		"{sha256:65}":        "invalid length",
+		"{host":              "unclosed {",
+		"images}/{basename}": "unexpected }",
+	} {
+		_, err := ParseFilenameTemplate(text)
+		assert.ErrorContains(t, err, want, text)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFileNameLength bounds the names taken from URLs, in bytes, leaving room
+// for a hash suffix within the usual limit of 255.
+const maxFileNameLength = 200
+
+// reservedFileNameChars replaces the characters that aren't allowed in file
+// names on some systems.
+var reservedFileNameChars = strings.NewReplacer(
+	"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_", "|", "_",
+)
+
+// urlFileName returns the name an image is saved under when the input doesn't
+// name it: the last element of the URL path, percent-decoded and without the
+// query, or the host for a URL without a path.
+func urlFileName(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return sanitizeFileName(path.Base(rawURL))
+	}
+
+	// Split the escaped path, so that an escaped slash stays in the name
+	segments := strings.Split(strings.TrimRight(parsed.EscapedPath(), "/"), "/")
+	name := segments[len(segments)-1]
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		name = unescaped
+	}
+	if name = sanitizeFileName(name); name == "" {
+		name = sanitizeFileName(parsed.Hostname())
+	}
+	if name == "" {
+		return "image"
+	}
+	return name
+}
+
+// sanitizeFileName makes name safe to use as a file name on any system:
+// reserved and control characters become underscores, and the surrounding
+// spaces and dots are trimmed. Long names are shortened, keeping their
+// extension.
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return '_'
+		}
+		return r
+	}, reservedFileNameChars.Replace(name))
+	name = strings.Trim(name, " .")
+
+	if len(name) > maxFileNameLength {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		stem := name[:maxFileNameLength-len(ext)]
+		for !utf8.ValidString(stem) {
+			stem = stem[:len(stem)-1]
+		}
+		name = stem + ext
+	}
+	return name
+}
+
+// hashSuffixedName inserts the first n hex digits of the SHA-256 digest of
+// rawURL before the extension of name, as in photo_1a2b3c4d.jpg.
+func hashSuffixedName(name, rawURL string, n int) string {
+	return digestSuffixedName(name, urlDigest(rawURL), n)
+}
+
+// hashSuffixedNames returns the names name is given when it collides with the
+// file of another URL, with longer and longer hashes of rawURL.
+func hashSuffixedNames(name, rawURL string) []string {
+	digest := urlDigest(rawURL)
+	var names []string
+	for n := 8; n <= len(digest); n *= 2 {
+		names = append(names, digestSuffixedName(name, digest, n))
+	}
+	return names
+}
+
+// urlDigest returns the SHA-256 digest of rawURL in hex.
+func urlDigest(rawURL string) string {
+	sum := sha256.Sum256([]byte(rawURL))
+	return hex.EncodeToString(sum[:])
+}
+
+func digestSuffixedName(name, digest string, n int) string {
+	if n > len(digest) {
+		n = len(digest)
+	}
+
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + "_" + digest[:n] + ext
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURLFileName(t *testing.T) {
+	for rawURL, want := range map[string]string{
+		"https://example.com/photos/1.jpg":             "1.jpg",
+		"https://example.com/img.php?id=7":             "img.php",
+		"https://example.com/photos/caf%C3%A9.jpg#top": "café.jpg",
+		"https://example.com/a%2Fb.jpg":                "a_b.jpg",
+		"https://example.com/gallery/":                 "gallery",
+		"https://example.com/":                         "example.com",
+		"https://example.com:8080":                     "example.com",
+		"https://example.com/what%3F%20.png":           "what_ .png",
+		"https://example.com/..%2F..%2Fetc":            "_.._etc",
+		"https://example.com/%00.jpg":                  "_.jpg",
+		"https://example.com/...":                      "example.com",
+	} {
+		assert.Equal(t, want, urlFileName(rawURL), rawURL)
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	assert.Equal(t, "a_b_c_d_e.jpg", sanitizeFileName(`a:b*c"d|e.jpg`))
+	assert.Equal(t, "name", sanitizeFileName(" .name. "))
+
+	long := sanitizeFileName(strings.Repeat("é", 150) + ".jpeg")
+	assert.LessOrEqual(t, len(long), maxFileNameLength)
+	assert.True(t, strings.HasSuffix(long, "é.jpeg"))
+}
+
+func TestHashSuffixedName(t *testing.T) {
+	// The SHA-256 digest of "hello" starts with 2cf24dba
+	assert.Equal(t, "1_2cf24dba.jpg", hashSuffixedName("1.jpg", "hello", 8))
+	assert.Equal(t, "photo_2cf24dba5fb0a30e", hashSuffixedName("photo", "hello", 16))
+	assert.Equal(t, "example_2cf24dba.com", hashSuffixedName("example.com", "hello", 8))
+}
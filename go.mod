@@ -6,6 +6,7 @@ require (
 	github.com/golang/mock v1.4.4
 	github.com/spf13/viper v1.16.0
 	github.com/stretchr/testify v1.8.4
+	golang.org/x/net v0.10.0
 )
 
 require (
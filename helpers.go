@@ -2,25 +2,80 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// ImageRequest is a single image to download, together with the options its
+// input record set for it.
+type ImageRequest struct {
+	URL string
+	// Filename replaces the name taken from the URL.
+	Filename string
+	// Subdir is the directory below the download directory to save to.
+	Subdir string
+	// SHA256 is the expected hex digest of the image.
+	SHA256 string
+	// Headers are sent along with the requests for the image.
+	Headers map[string]string
+	// MaxSize replaces the configured size limit if not zero. -1 means no limit.
+	MaxSize int64
+	// Priority orders the downloads, higher first.
+	Priority int
+	// Index is the position of the request in the input, from 1.
+	Index int
+	// Metadata holds the other values of the input record, for the
+	// filename_template.
+	Metadata map[string]string
+}
+
+// SizeLimit returns the size limit for the image, given the configured one.
+func (r ImageRequest) SizeLimit(defaultLimit int64) int64 {
+	if r.MaxSize != 0 {
+		return r.MaxSize
+	}
+	return defaultLimit
+}
+
+// Header returns the extra request headers as an http.Header.
+func (r ImageRequest) Header() http.Header {
+	header := make(http.Header, len(r.Headers))
+	for name, value := range r.Headers {
+		header.Set(name, value)
+	}
+	return header
+}
+
 type Downloader interface {
-	DownloadImage(url, downloadDir string) error
+	DownloadImage(ctx context.Context, req ImageRequest, downloadDir string) error
 }
 
+// URLReader opens the input files. Inputs that are fetched, and the documents
+// they lead to, are fetched under ctx, also while the stream is read.
 type URLReader interface {
-	ReadImageURLsFromFile(filePath string) ([]string, error)
+	OpenImageRequests(ctx context.Context, filePath string) (ImageRequestStream, error)
+}
+
+// ImageRequestStream yields the requests of an input file one at a time, so
+// lists of any length are downloaded without loading them into memory.
+type ImageRequestStream interface {
+	// Next returns the next request, or io.EOF after the last one.
+	Next() (ImageRequest, error)
+	Close() error
 }
 
 type ImageSizeChecker interface {
-	IsImageSizeExceeded(url string, maxSize int64) bool
+	IsImageSizeExceeded(ctx context.Context, url string, maxSize int64) bool
 }
 
 type FileChecker interface {
@@ -28,7 +83,26 @@ type FileChecker interface {
 }
 
 type FileSizeGetter interface {
-	GetImageFileSize(url string) (int64, error)
+	GetImageFileSize(ctx context.Context, url string) (int64, error)
+}
+
+// FileInfoGetter returns what a HEAD request tells about a remote image.
+type FileInfoGetter interface {
+	GetImageFileInfo(ctx context.Context, url string, header http.Header) (*RemoteFileInfo, error)
+}
+
+// ErrSizeUnknown is returned when the server doesn't tell the size of an image
+// without downloading it.
+var ErrSizeUnknown = errors.New("image size unknown")
+
+// RemoteFileInfo describes a remote image without downloading it.
+type RemoteFileInfo struct {
+	Size         int64
+	AcceptRanges bool
+	ETag         string
+	LastModified string
+	// Header is the whole response header.
+	Header http.Header
 }
 
 type WaitTimeGenerator interface {
@@ -42,6 +116,14 @@ type Helper struct {
 	FileChecker       FileChecker
 	FileSizeGetter    FileSizeGetter
 	WaitTimeGenerator WaitTimeGenerator
+	// PageExtractor finds the images on the pages of an html input.
+	PageExtractor PageExtractor
+	// DownloadIndex tells which URL the files in the download directory were
+	// saved from, so images aren't named after files of other URLs.
+	DownloadIndex *DownloadIndex
+	// FeedState, if set, is saved at the end of a run in which no download
+	// failed, so the failed items of a feed are read again by the next run.
+	FeedState *FeedState
 }
 
 func NewHelper(
@@ -51,6 +133,8 @@ func NewHelper(
 	fileChecker FileChecker,
 	fileSizeGetter FileSizeGetter,
 	waitTimeGenerator WaitTimeGenerator,
+	pageExtractor PageExtractor,
+	downloadIndex *DownloadIndex,
 ) *Helper {
 	return &Helper{
 		Downloader:        downloader,
@@ -59,29 +143,136 @@ func NewHelper(
 		FileChecker:       fileChecker,
 		FileSizeGetter:    fileSizeGetter,
 		WaitTimeGenerator: waitTimeGenerator,
+		PageExtractor:     pageExtractor,
+		DownloadIndex:     downloadIndex,
 	}
 }
 
-func (h *Helper) DownloadImages(config *Config) error {
-	imageURLs, err := h.URLReader.ReadImageURLsFromFile(config.ImageURLFile)
+func (h *Helper) DownloadImages(ctx context.Context, config *Config) error {
+	stream, err := openImageRequests(ctx, h.URLReader, config.ImageURLFiles)
 	if err != nil {
 		return fmt.Errorf("failed to read image URLs from file: %v", err)
 	}
 
+	// Unless the input must be clean, skip its invalid lines
+	var rejected *RejectedLineReport
+	if !config.StrictInput {
+		rejected, err = NewRejectedLineReport(config.RejectedLinesFile)
+		if err != nil {
+			stream.Close()
+			return fmt.Errorf("failed to create rejected line report: %v", err)
+		}
+		defer rejected.Close()
+		stream = newRejectingStream(stream, rejected)
+	}
+
+	var report *FailureReport
+	if !config.FailFast {
+		report, err = NewFailureReport(config.FailedURLFile)
+		if err != nil {
+			stream.Close()
+			return fmt.Errorf("failed to create failed URL report: %v", err)
+		}
+		defer report.Close()
+	}
+
+	// The URLs of an html input are pages, download the images on them instead
+	var pages *pageStream
+	if config.InputURLType == InputURLHTML {
+		pages = newPageStream(ctx, stream, h.PageExtractor, report)
+		stream = pages
+	}
+
+	normalizer, err := newURLNormalizer(config.NormalizeURLs, config.StripQueryParams)
+	if err != nil {
+		stream.Close()
+		return fmt.Errorf("invalid URL normalization: %v", err)
+	}
+	var normalized *normalizingStream
+	if normalizer != nil || config.DedupeURLs {
+		normalized = newNormalizingStream(stream, normalizer, config.DedupeURLs)
+		stream = normalized
+	}
+	// Name the images in input order, before they are reordered
+	named := newNamingStream(stream, h.DownloadIndex, config.DownloadDirectory)
+	stream = named
+	if config.PriorityWindow > 1 {
+		stream = newPriorityStream(stream, config.PriorityWindow)
+	}
+	defer stream.Close()
+
 	err = h.ensureDownloadDirectory(config.DownloadDirectory)
 	if err != nil {
 		return fmt.Errorf("failed to ensure download directory: %v", err)
 	}
 
-	batches := batchImageURLs(imageURLs, config.BatchSize)
-	for _, batch := range batches {
-		err := h.downloadBatch(batch, config.DownloadDirectory, config.MaxImageSizeMB)
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = config.BatchSize
+	}
+
+	var summary DownloadSummary
+	defer func() {
+		log.Printf("Downloaded %d images, skipped %d, failed %d", summary.Succeeded, summary.Skipped, summary.Failed)
+		if rejected != nil && rejected.Count > 0 {
+			log.Printf("Skipped %d invalid input lines", rejected.Count)
+		}
+		if pages != nil {
+			log.Printf("Read %d pages, failed %d", pages.Pages, pages.Failed)
+		}
+		if normalized != nil && normalized.Duplicates > 0 {
+			log.Printf("Collapsed %d duplicate URLs", normalized.Duplicates)
+		}
+		if named.Renamed > 0 {
+			log.Printf("Added a URL hash to %d file names taken by other URLs", named.Renamed)
+		}
+	}()
+
+	for {
+		batch, err := nextBatch(stream, config.BatchSize)
 		if err != nil {
-			return fmt.Errorf("failed to download image batch: %v", err)
+			return fmt.Errorf("failed to read image URLs from file: %w", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := h.downloadBatch(ctx, batch, config, concurrency)
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("download interrupted: %w", err)
+		}
+		summary.Add(results)
+
+		if config.FailFast {
+			if err := resultsError(results); err != nil {
+				return fmt.Errorf("failed to download image batch: %v", err)
+			}
+		} else if err := report.Write(results); err != nil {
+			return fmt.Errorf("failed to write failed URL report: %v", err)
 		}
 
 		waitTime := h.WaitTimeGenerator.GenerateRandomWaitTime(config.MinWaitTime, config.MaxWaitTime)
-		time.Sleep(waitTime)
+		if err := sleepContext(ctx, waitTime); err != nil {
+			return fmt.Errorf("download interrupted: %w", err)
+		}
+	}
+
+	if report != nil {
+		if err := report.Close(); err != nil {
+			return fmt.Errorf("failed to write failed URL report: %v", err)
+		}
+		if failed := summary.Failed + pagesFailed(pages); failed > 0 {
+			log.Printf("Wrote %d failed URLs to %s", failed, config.FailedURLFile)
+		}
+	}
+
+	// Only remember the feed items once their images were downloaded
+	if h.FeedState != nil {
+		if failed := summary.Failed + pagesFailed(pages); failed > 0 {
+			log.Printf("Not saving the feed state, %d downloads failed", failed)
+		} else if err := h.FeedState.Save(); err != nil {
+			return fmt.Errorf("failed to save feed state: %v", err)
+		}
 	}
 
 	return nil
@@ -98,50 +289,124 @@ func (h *Helper) ensureDownloadDirectory(directory string) error {
 	return nil
 }
 
-func (h *Helper) downloadBatch(batch []string, downloadDir string, maxImageSizeMB string) error {
-	for _, url := range batch {
-		if h.FileChecker.IsFileExists(url) {
-			continue
-		}
+// DownloadResult is the outcome of downloading a single URL of a batch. A
+// skipped URL was neither downloaded nor failed, e.g. because the image had
+// already been downloaded.
+type DownloadResult struct {
+	URL     string
+	Skipped bool
+	Err     error
+}
 
-		m, err := strconv.ParseInt(maxImageSizeMB, 10, 64)
+// DownloadSummary counts the outcomes of a run.
+type DownloadSummary struct {
+	Succeeded int
+	Skipped   int
+	Failed    int
+}
 
-		if err != nil {
-			return fmt.Errorf("failed to parse maxImageSizeMB: %v", err)
+func (s *DownloadSummary) Add(results []DownloadResult) {
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			s.Failed++
+		case result.Skipped:
+			s.Skipped++
+		default:
+			s.Succeeded++
 		}
+	}
+}
+
+// downloadBatch downloads every URL of the batch using at most concurrency
+// workers and returns one result per URL, in batch order. URLs that were not
+// started before ctx was cancelled report the context error.
+func (h *Helper) downloadBatch(ctx context.Context, batch []ImageRequest, config *Config, concurrency int) []DownloadResult {
+	results := make([]DownloadResult, len(batch))
+	if concurrency <= 0 || concurrency > len(batch) {
+		concurrency = len(batch)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				skipped, err := h.downloadURL(ctx, batch[i], config)
+				results[i] = DownloadResult{URL: batch[i].URL, Skipped: skipped, Err: err}
+			}
+		}()
+	}
 
-		if !h.ImageSizeChecker.IsImageSizeExceeded(url, m) {
-			err := h.Downloader.DownloadImage(url, downloadDir)
-			if err != nil {
-				return fmt.Errorf("failed to download image: %v", err)
+dispatch:
+	for i := range batch {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			for ; i < len(batch); i++ {
+				results[i] = DownloadResult{URL: batch[i].URL, Err: ctx.Err()}
 			}
+			break dispatch
 		}
 	}
+	close(jobs)
+	wg.Wait()
 
-	return nil
+	return results
 }
 
-func (h *Helper) ReadImageURLsFromFile(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
+// downloadURL downloads a single image and reports whether it was skipped
+// instead, because it was already downloaded or is too large.
+func (h *Helper) downloadURL(ctx context.Context, req ImageRequest, config *Config) (bool, error) {
+	if h.FileChecker.IsFileExists(req.URL) {
+		return true, nil
+	}
+
+	// The pre-check can't send the extra headers a request may need, leave
+	// those to the limit the download enforces
+	limit := req.SizeLimit(config.MaxImageSize)
+	if config.SizePrecheck && len(req.Headers) == 0 && h.ImageSizeChecker.IsImageSizeExceeded(ctx, req.URL, limit) {
+		return true, nil
+	}
+
+	err := h.Downloader.DownloadImage(ctx, req, config.DownloadDirectory)
+	if errors.Is(err, ErrFileExists) || errors.Is(err, ErrImageTooLarge) {
+		return true, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to open image URL file: %v", err)
+		return false, fmt.Errorf("failed to download image: %w", err)
 	}
-	defer file.Close()
 
-	var imageURLs []string
-	buf := make([]byte, 1024)
-	for {
-		n, err := file.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, fmt.Errorf("failed to read image URLs from file: %v", err)
+	return false, nil
+}
+
+// resultsError combines the errors of all failed results, or returns nil if
+// every download succeeded.
+func resultsError(results []DownloadResult) error {
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.URL, result.Err))
 		}
-		imageURLs = append(imageURLs, string(buf[:n]))
 	}
 
-	return imageURLs, nil
+	return errors.Join(errs...)
+}
+
+// sleepContext pauses for d, returning early with the context error if ctx is
+// cancelled first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (h *Helper) IsFileExists(filePath string) bool {
@@ -156,8 +421,9 @@ func (h *Helper) GenerateRandomWaitTime(min, max float64) time.Duration {
 
 func NewImageDownloader(httpClient HTTPClient, fileChecker FileChecker) *ImageDownloader {
 	return &ImageDownloader{
-		HTTPClient:  httpClient,
-		FileChecker: fileChecker,
+		HTTPClient:    httpClient,
+		FileChecker:   fileChecker,
+		DownloadIndex: &DownloadIndex{},
 	}
 }
 
@@ -176,72 +442,159 @@ func NewDefaultURLReader() *DefaultURLReader {
 	return &DefaultURLReader{}
 }
 
+// DefaultURLReader reads plain URL lists, one URL per line.
 type DefaultURLReader struct{}
 
-func (r *DefaultURLReader) ReadImageURLsFromFile(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
+func (r *DefaultURLReader) OpenImageRequests(ctx context.Context, filePath string) (ImageRequestStream, error) {
+	file, err := openInput(ctx, filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open image URL file: %v", err)
 	}
-	defer file.Close()
 
-	var imageURLs []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		imageURLs = append(imageURLs, scanner.Text())
-	}
+	return &urlListStream{path: inputName(filePath), file: file, reader: bufio.NewReader(file)}, nil
+}
+
+// urlListStream reads a file with one URL per line, of any length. Whitespace
+// around the URL is trimmed, and anything after a tab ignored. Blank lines and
+// lines starting with # are skipped.
+type urlListStream struct {
+	path   string
+	file   io.ReadCloser
+	reader *bufio.Reader
+	line   int
+}
+
+func (s *urlListStream) Next() (ImageRequest, error) {
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return ImageRequest{}, fmt.Errorf("failed to read image URLs from file: %w", err)
+		}
+		if err == io.EOF && line == "" {
+			return ImageRequest{}, io.EOF
+		}
+		s.line++
+
+		text := strings.TrimSpace(line)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// Anything after a tab annotates the URL, as in the failed URL report
+		url, _, _ := strings.Cut(text, "\t")
+		url = strings.TrimSpace(url)
+		if err := validateImageURL(url); err != nil {
+			return ImageRequest{}, &InputLineError{File: s.path, Line: s.line, Text: text, Err: err}
+		}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read image URLs from file: %v", err)
+		return ImageRequest{URL: url}, nil
 	}
+}
+
+func (s *urlListStream) lastLine() int {
+	return s.line
+}
 
-	return imageURLs, nil
+func (s *urlListStream) Close() error {
+	return s.file.Close()
 }
 
-func NewDefaultImageSizeChecker() *DefaultImageSizeChecker {
-	return &DefaultImageSizeChecker{}
+func NewDefaultImageSizeChecker(fileSizeGetter FileSizeGetter) *DefaultImageSizeChecker {
+	return &DefaultImageSizeChecker{FileSizeGetter: fileSizeGetter}
 }
 
 type DefaultImageSizeChecker struct {
 	FileSizeGetter FileSizeGetter
 }
 
-func (c *DefaultImageSizeChecker) IsImageSizeExceeded(url string, maxSize int64) bool {
-	if maxSize == -1 {
+// IsImageSizeExceeded checks the size reported by a HEAD request. Images whose
+// size the HEAD request doesn't tell pass, whether the server doesn't report it
+// or rejects the request: the download enforces the limit on the body itself,
+// and fails on its own if the image can't be fetched.
+func (c *DefaultImageSizeChecker) IsImageSizeExceeded(ctx context.Context, url string, maxSize int64) bool {
+	if maxSize <= 0 {
 		return false
 	}
 
-	size, err := c.FileSizeGetter.GetImageFileSize(url)
+	size, err := c.FileSizeGetter.GetImageFileSize(ctx, url)
 	if err != nil {
-		return true
+		return false
 	}
 
 	return size > maxSize
 }
 
-func NewDefaultFileSizeGetter() *DefaultFileSizeGetter {
-	return &DefaultFileSizeGetter{}
+func NewDefaultFileSizeGetter(httpClient HTTPClient) *DefaultFileSizeGetter {
+	return &DefaultFileSizeGetter{HTTPClient: httpClient}
+}
+
+type DefaultFileSizeGetter struct {
+	HTTPClient  HTTPClient
+	RetryPolicy *RetryPolicy
+}
+
+func (f *DefaultFileSizeGetter) GetImageFileSize(ctx context.Context, url string) (int64, error) {
+	info, err := f.GetImageFileInfo(ctx, url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size, nil
+}
+
+// GetImageFileInfo sends a HEAD request for url with the given extra headers.
+func (f *DefaultFileSizeGetter) GetImageFileInfo(ctx context.Context, url string, header http.Header) (*RemoteFileInfo, error) {
+	var info *RemoteFileInfo
+	err := f.RetryPolicy.Do(ctx, "get the size of "+url, func() error {
+		var err error
+		info, err = f.headImageFileInfo(ctx, url, header)
+		return err
+	})
+
+	return info, err
 }
 
-type DefaultFileSizeGetter struct{}
+func (f *DefaultFileSizeGetter) headImageFileInfo(ctx context.Context, url string, header http.Header) (*RemoteFileInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
 
-func (f *DefaultFileSizeGetter) GetImageFileSize(url string) (int64, error) {
-	resp, err := http.Head(url)
+	resp, err := f.HTTPClient.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get image file size: %v", err)
+		return nil, fmt.Errorf("failed to get image file size: %w", err)
 	}
 	defer resp.Body.Close()
 
+	// Plenty of servers don't implement HEAD at all
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		return nil, fmt.Errorf("%w: HEAD %s", ErrSizeUnknown, resp.Status)
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("failed to get image file size, status: %s", resp.Status)
+		return nil, fmt.Errorf("failed to get image file size, %w", &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	contentLength := resp.Header.Get("Content-Length")
+	if contentLength == "" {
+		return nil, fmt.Errorf("%w: no Content-Length", ErrSizeUnknown)
 	}
 
-	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	size, err := strconv.ParseInt(contentLength, 10, 64)
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse image file size: %v", err)
+		return nil, fmt.Errorf("failed to parse image file size: %v", err)
 	}
 
-	return size, nil
+	return &RemoteFileInfo{
+		Size:         size,
+		AcceptRanges: resp.Header.Get("Accept-Ranges") == "bytes",
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Header:       resp.Header,
+	}, nil
 }
 
 func NewDefaultWaitTimeGenerator() *DefaultWaitTimeGenerator {
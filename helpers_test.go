@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -14,79 +24,217 @@ func TestEnsureDownloadDirectory_DirectoryExists(t *testing.T) {
 	tempDir := t.TempDir()
 
 	// Ensure the download directory
-	err := ensureDownloadDirectory(tempDir)
+	helper := &Helper{FileChecker: NewDefaultFileChecker()}
+	err := helper.ensureDownloadDirectory(tempDir)
 	assert.NoError(t, err)
 }
 
-func TestReadImageURLsFromFile(t *testing.T) {
+func TestDefaultURLReader(t *testing.T) {
 	// Create a temporary file with image URLs
 	tempFile := createTempFile(t, []byte("https://example.com/image1.jpg\nhttps://example.com/image2.jpg\nhttps://example.com/image3.jpg"))
 
 	// Read the image URLs from the file
-	imageURLs, err := readImageURLsFromFile(tempFile)
+	requests, err := readAllImageRequests(NewDefaultURLReader(), tempFile)
 	assert.NoError(t, err)
 
 	// Assert the image URLs
-	assert.Equal(t, []string{"https://example.com/image1.jpg", "https://example.com/image2.jpg", "https://example.com/image3.jpg"}, imageURLs)
+	assert.Equal(t, []string{"https://example.com/image1.jpg", "https://example.com/image2.jpg", "https://example.com/image3.jpg"}, requestURLs(requests))
 }
 
-func TestReadImageURLsFromFile_EmptyFile(t *testing.T) {
+func TestDefaultURLReader_LineHygiene(t *testing.T) {
+	tempFile := createTempFile(t, []byte("# product images\r\n"+
+		"  https://example.com/image1.jpg  \r\n"+
+		"\r\n"+
+		"\t\n"+
+		"not a url\n"+
+		"https://example.com/image2.jpg\thttp_status\t404\tnot found\n"+
+		"   # indented comment\n"+
+		"ftp://example.com/image3.jpg\n"+
+		"https://example.com/image4.jpg"))
+
+	stream, err := NewDefaultURLReader().OpenImageRequests(context.Background(), tempFile)
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	var urls []string
+	var rejected []int
+	for {
+		req, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		var lineErr *InputLineError
+		if errors.As(err, &lineErr) {
+			rejected = append(rejected, lineErr.Line)
+			continue
+		}
+		assert.NoError(t, err)
+		urls = append(urls, req.URL)
+	}
+
+	assert.Equal(t, []string{
+		"https://example.com/image1.jpg",
+		"https://example.com/image2.jpg",
+		"https://example.com/image4.jpg",
+	}, urls)
+	assert.Equal(t, []int{5, 8}, rejected)
+}
+
+func TestDefaultURLReader_LongURLs(t *testing.T) {
+	// Longer than the 64KB bufio.Scanner limit, and across many read chunks
+	longURL := "https://example.com/image.jpg?q=" + strings.Repeat("a", 100*1024)
+	chunkURL := "https://example.com/" + strings.Repeat("b", 1000) + ".jpg"
+	tempFile := createTempFile(t, []byte(chunkURL+"\n"+longURL+"\r\n"+chunkURL+"\n"+longURL))
+
+	requests, err := readAllImageRequests(NewDefaultURLReader(), tempFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{chunkURL, longURL, chunkURL, longURL}, requestURLs(requests))
+}
+
+func TestDefaultURLReader_EmptyFile(t *testing.T) {
 	// Create a temporary empty file
 	tempFile := createTempFile(t, []byte{})
 
 	// Read the image URLs from the file
-	imageURLs, err := readImageURLsFromFile(tempFile)
+	requests, err := readAllImageRequests(NewDefaultURLReader(), tempFile)
 	assert.NoError(t, err)
 
 	// Assert the image URLs
-	assert.Empty(t, imageURLs)
+	assert.Empty(t, requests)
 }
 
-func TestReadImageURLsFromFile_NonexistentFile(t *testing.T) {
+func TestDefaultURLReader_NonexistentFile(t *testing.T) {
 	// Read from a non-existent file
-	imageURLs, err := readImageURLsFromFile("nonexistent.txt")
+	stream, err := NewDefaultURLReader().OpenImageRequests(context.Background(), "nonexistent.txt")
 
-	// Assert the error and image URLs
+	// Assert the error and stream
 	assert.Error(t, err)
-	assert.Nil(t, imageURLs)
+	assert.Nil(t, stream)
 }
 
-func TestBatchImageURLs(t *testing.T) {
-	// Create a list of image URLs
-	imageURLs := []string{
+func TestDownloadBatch_Concurrency(t *testing.T) {
+	downloader := &blockingDownloader{release: make(chan struct{})}
+	helper := &Helper{
+		Downloader:       downloader,
+		ImageSizeChecker: &stubImageSizeChecker{},
+		FileChecker:      NewDefaultFileChecker(),
+	}
+
+	batch := imageRequests(
 		"https://example.com/image1.jpg",
 		"https://example.com/image2.jpg",
 		"https://example.com/image3.jpg",
 		"https://example.com/image4.jpg",
-		"https://example.com/image5.jpg",
-		"https://example.com/image6.jpg",
-		"https://example.com/image7.jpg",
-		"https://example.com/image8.jpg",
-		"https://example.com/image9.jpg",
-		"https://example.com/image10.jpg",
-		"https://example.com/image11.jpg",
+	)
+
+	done := make(chan []DownloadResult)
+	go func() {
+		done <- helper.downloadBatch(context.Background(), batch, &Config{DownloadDirectory: t.TempDir()}, 2)
+	}()
+
+	// Let the first workers start before releasing them
+	time.Sleep(50 * time.Millisecond)
+	close(downloader.release)
+
+	results := <-done
+	assert.Len(t, results, len(batch))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&downloader.maxInFlight))
+}
+
+func TestDownloadBatch_CollectsEveryFailure(t *testing.T) {
+	downloader := &blockingDownloader{
+		release: make(chan struct{}),
+		fail: map[string]bool{
+			"https://example.com/image1.jpg": true,
+			"https://example.com/image3.jpg": true,
+		},
+	}
+	close(downloader.release)
+	helper := &Helper{
+		Downloader:       downloader,
+		ImageSizeChecker: &stubImageSizeChecker{},
+		FileChecker:      NewDefaultFileChecker(),
 	}
 
-	// Batch the image URLs
-	batches := batchImageURLs(imageURLs, 5)
+	batch := imageRequests(
+		"https://example.com/image1.jpg",
+		"https://example.com/image2.jpg",
+		"https://example.com/image3.jpg",
+	)
+	results := helper.downloadBatch(context.Background(), batch, &Config{DownloadDirectory: t.TempDir()}, 3)
 
-	// Assert the batches
-	assert.Equal(t, [][]string{
-		{"https://example.com/image1.jpg", "https://example.com/image2.jpg", "https://example.com/image3.jpg", "https://example.com/image4.jpg", "https://example.com/image5.jpg"},
-		{"https://example.com/image6.jpg", "https://example.com/image7.jpg", "https://example.com/image8.jpg", "https://example.com/image9.jpg", "https://example.com/image10.jpg"},
-		{"https://example.com/image11.jpg"},
-	}, batches)
+	assert.Error(t, results[0].Err)
+	assert.NoError(t, results[1].Err)
+	assert.Error(t, results[2].Err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&downloader.calls))
+
+	err := resultsError(results)
+	assert.ErrorContains(t, err, "https://example.com/image1.jpg")
+	assert.ErrorContains(t, err, "https://example.com/image3.jpg")
 }
 
-func TestBatchImageURLs_EmptyURLs(t *testing.T) {
-	// Create an empty list of image URLs
-	imageURLs := []string{}
+func TestDownloadImages_Cancelled(t *testing.T) {
+	downloader := &blockingDownloader{release: make(chan struct{})}
+	close(downloader.release)
+	helper := &Helper{
+		Downloader:        downloader,
+		URLReader:         NewDefaultURLReader(),
+		ImageSizeChecker:  &stubImageSizeChecker{},
+		FileChecker:       NewDefaultFileChecker(),
+		WaitTimeGenerator: NewDefaultWaitTimeGenerator(),
+	}
+
+	tempFile := createTempFile(t, []byte("https://example.com/image1.jpg\nhttps://example.com/image2.jpg"))
+	config := &Config{
+		ImageURLFiles:     []string{tempFile},
+		DownloadDirectory: t.TempDir(),
+		BatchSize:         1,
+		MinWaitTime:       60,
+		MaxWaitTime:       60,
+		MaxImageSize:      -1,
+		FailFast:          true,
+	}
 
-	// Batch the image URLs
-	batches := batchImageURLs(imageURLs, 5)
+	// Cancel while the helper waits between the two batches
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
 
-	// Assert the batches
-	assert.Empty(t, batches)
+	err := helper.DownloadImages(ctx, config)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloader.calls))
+}
+
+func TestDownloadImages_Priority(t *testing.T) {
+	downloader := &recordingDownloader{}
+	helper := &Helper{
+		Downloader:        downloader,
+		URLReader:         NewManifestURLReader(),
+		ImageSizeChecker:  &stubImageSizeChecker{},
+		FileChecker:       NewDefaultFileChecker(),
+		WaitTimeGenerator: NewDefaultWaitTimeGenerator(),
+	}
+
+	tempFile := createTempFile(t, []byte(`{"url": "https://example.com/low.jpg", "priority": -1}
+{"url": "https://example.com/first.jpg"}
+{"url": "https://example.com/high.jpg", "priority": 10}
+{"url": "https://example.com/second.jpg"}`))
+	config := &Config{
+		ImageURLFiles:     []string{tempFile},
+		DownloadDirectory: t.TempDir(),
+		BatchSize:         1,
+		MaxImageSize:      -1,
+		FailFast:          true,
+		PriorityWindow:    10,
+	}
+
+	err := helper.DownloadImages(context.Background(), config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"https://example.com/high.jpg",
+		"https://example.com/first.jpg",
+		"https://example.com/second.jpg",
+		"https://example.com/low.jpg",
+	}, downloader.urls)
 }
 
 func TestDownloadImage_FileExists(t *testing.T) {
@@ -98,8 +246,12 @@ func TestDownloadImage_FileExists(t *testing.T) {
 	err := ioutil.WriteFile(dummyFile, []byte("dummy"), 0644)
 	assert.NoError(t, err)
 
+	// Set up a server that serves the image
+	server := createImageServer(t)
+
 	// Download an image
-	err = downloadImage("https://via.placeholder.com/150", tempDir)
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	err = downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/150"}, tempDir)
 	assert.NoError(t, err)
 
 	// Check if the image file exists
@@ -117,19 +269,39 @@ func TestDownloadImage_FileExists(t *testing.T) {
 }
 
 func TestGetImageFileSize(t *testing.T) {
+	server := createImageServer(t)
+
 	// Get the size of a remote image
-	size, err := getImageFileSize("https://via.placeholder.com/150")
+	size, err := NewDefaultFileSizeGetter(NewStandardHTTPClient()).GetImageFileSize(context.Background(), server.URL+"/150")
 	assert.NoError(t, err)
 	assert.NotZero(t, size)
 }
 
 func TestGetImageFileSize_InvalidURL(t *testing.T) {
+	server := createImageServer(t)
+
 	// Get the size of an invalid image URL
-	size, err := getImageFileSize("https://example.com/invalid.jpg")
+	size, err := NewDefaultFileSizeGetter(NewStandardHTTPClient()).GetImageFileSize(context.Background(), server.URL+"/invalid.jpg")
 	assert.Error(t, err)
 	assert.Zero(t, size)
 }
 
+func TestGetImageFileSize_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// A HEAD request that stalls is cut off by the timeout of the client
+	getter := NewDefaultFileSizeGetter(NewStandardHTTPClientWithTimeout(50 * time.Millisecond))
+	start := time.Now()
+	_, err := getter.GetImageFileSize(context.Background(), server.URL+"/150")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
 func TestParseMaxImageSize(t *testing.T) {
 	// Parse max image size in MB
 	size, err := parseMaxImageSize("5")
@@ -152,26 +324,138 @@ func TestParseMaxImageSize_InvalidSize(t *testing.T) {
 }
 
 func TestIsImageSizeExceeded(t *testing.T) {
+	server := createImageServer(t)
+	checker := &DefaultImageSizeChecker{FileSizeGetter: NewDefaultFileSizeGetter(NewStandardHTTPClient())}
+
 	// Check if image size is exceeded
 	size := int64(5 * 1024 * 1024)
-	exceeded := isImageSizeExceeded("https://via.placeholder.com/150", size)
+	exceeded := checker.IsImageSizeExceeded(context.Background(), server.URL+"/150", size)
 	assert.False(t, exceeded)
 }
 
 func TestIsImageSizeExceeded_InvalidURL(t *testing.T) {
-	// Check if image size is exceeded with an invalid URL
+	server := createImageServer(t)
+	checker := &DefaultImageSizeChecker{FileSizeGetter: NewDefaultFileSizeGetter(NewStandardHTTPClient())}
+
+	// A failed HEAD request leaves the image to the download, which reports the error
 	size := int64(5 * 1024 * 1024)
-	exceeded := isImageSizeExceeded("https://example.com/invalid.jpg", size)
-	assert.True(t, exceeded)
+	exceeded := checker.IsImageSizeExceeded(context.Background(), server.URL+"/invalid.jpg", size)
+	assert.False(t, exceeded)
+}
+
+func TestIsImageSizeExceeded_SizeUnknown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+	checker := NewDefaultImageSizeChecker(NewDefaultFileSizeGetter(NewStandardHTTPClient()))
+
+	// A server that won't tell the size is left to the download to enforce
+	exceeded := checker.IsImageSizeExceeded(context.Background(), server.URL+"/image.jpg", 1024)
+	assert.False(t, exceeded)
+}
+
+func TestDownloadURL_FailedPrecheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	helper := &Helper{
+		Downloader:       NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker()),
+		ImageSizeChecker: NewDefaultImageSizeChecker(NewDefaultFileSizeGetter(NewStandardHTTPClient())),
+		FileChecker:      NewDefaultFileChecker(),
+	}
+	config := &Config{DownloadDirectory: t.TempDir(), MaxImageSize: 1024, SizePrecheck: true}
+
+	// A rejected HEAD request doesn't make the image a skip, the download fails
+	skipped, err := helper.downloadURL(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, config)
+	assert.False(t, skipped)
+	assert.ErrorContains(t, err, "404")
 }
 
 func TestGenerateRandomWaitTime(t *testing.T) {
 	// Generate random wait time
-	waitTime := generateRandomWaitTime(0.8, 3.0)
+	waitTime := NewDefaultWaitTimeGenerator().GenerateRandomWaitTime(0.8, 3.0)
 	assert.GreaterOrEqual(t, waitTime.Seconds(), 0.8)
 	assert.LessOrEqual(t, waitTime.Seconds(), 3.0)
 }
 
+type blockingDownloader struct {
+	release     chan struct{}
+	fail        map[string]bool
+	calls       int32
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (d *blockingDownloader) DownloadImage(ctx context.Context, req ImageRequest, downloadDir string) error {
+	atomic.AddInt32(&d.calls, 1)
+	n := atomic.AddInt32(&d.inFlight, 1)
+	defer atomic.AddInt32(&d.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&d.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&d.maxInFlight, max, n) {
+			break
+		}
+	}
+
+	select {
+	case <-d.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if d.fail[req.URL] {
+		return errors.New("download failed")
+	}
+	return nil
+}
+
+// recordingDownloader records the URLs it is asked to download, in order.
+type recordingDownloader struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+func (d *recordingDownloader) DownloadImage(ctx context.Context, req ImageRequest, downloadDir string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.urls = append(d.urls, req.URL)
+	return nil
+}
+
+func imageRequests(urls ...string) []ImageRequest {
+	requests := make([]ImageRequest, len(urls))
+	for i, url := range urls {
+		requests[i] = ImageRequest{URL: url}
+	}
+	return requests
+}
+
+type stubImageSizeChecker struct{}
+
+func (c *stubImageSizeChecker) IsImageSizeExceeded(ctx context.Context, url string, maxSize int64) bool {
+	return false
+}
+
+func createImageServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/150" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(bytes.Repeat([]byte{0x89}, 150))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
 func createTempFile(t *testing.T, content []byte) string {
 	tempFile, err := ioutil.TempFile("", "testfile")
 	assert.NoError(t, err)
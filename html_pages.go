@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Input URL types for the input_url_type key.
+const (
+	InputURLImage = "image"
+	InputURLHTML  = "html"
+)
+
+func validInputURLType(urlType string) bool {
+	switch urlType {
+	case InputURLImage, InputURLHTML, "":
+		return true
+	}
+	return false
+}
+
+// maxPageSize is how much of an HTML page is read for image URLs.
+const maxPageSize = 16 << 20
+
+// PageExtractor finds the image URLs of a page.
+type PageExtractor interface {
+	ExtractImageURLs(ctx context.Context, page ImageRequest) ([]string, error)
+}
+
+// HTMLPageExtractor fetches HTML pages and collects the images they show: img
+// src and srcset, picture sources, og:image meta tags and CSS background images.
+type HTMLPageExtractor struct {
+	HTTPClient  HTTPClient
+	RetryPolicy *RetryPolicy
+}
+
+func NewHTMLPageExtractor(httpClient HTTPClient) *HTMLPageExtractor {
+	return &HTMLPageExtractor{HTTPClient: httpClient}
+}
+
+func (e *HTMLPageExtractor) ExtractImageURLs(ctx context.Context, page ImageRequest) ([]string, error) {
+	var imageURLs []string
+	err := e.RetryPolicy.Do(ctx, "fetch page "+page.URL, func() error {
+		var err error
+		imageURLs, err = e.fetchPage(ctx, page)
+		return err
+	})
+
+	return imageURLs, err
+}
+
+func (e *HTMLPageExtractor) fetchPage(ctx context.Context, page ImageRequest) ([]string, error) {
+	req, err := newImageRequest(ctx, page)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := e.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch page: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch page, %w", &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "" &&
+		mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("failed to fetch page: %s is not an HTML page but %s", page.URL, mediaType)
+	}
+
+	// Resolve against where redirects ended up
+	base := req.URL
+	if resp.Request != nil {
+		base = resp.Request.URL
+	}
+	imageURLs, err := extractImageURLs(io.LimitReader(resp.Body, maxPageSize), base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page: %w", err)
+	}
+
+	return imageURLs, nil
+}
+
+// backgroundImage matches the value of a background or background-image CSS
+// declaration, and cssURL the url() references in it.
+var (
+	backgroundImage = regexp.MustCompile(`(?i)background(?:-image)?\s*:([^;}]*)`)
+	cssURL          = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)'"\s]*))\s*\)`)
+)
+
+// ogImageProperties are the meta properties that name the image of a page.
+var ogImageProperties = map[string]bool{
+	"og:image":            true,
+	"og:image:url":        true,
+	"og:image:secure_url": true,
+}
+
+// extractImageURLs collects the image URLs of an HTML document, resolved
+// against base or the document's own <base href>, in document order and
+// without duplicates.
+func extractImageURLs(r io.Reader, base *url.URL) ([]string, error) {
+	var candidates []string
+	tokenizer := html.NewTokenizer(r)
+	inStyle := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if tokenizer.Err() != io.EOF {
+				return nil, tokenizer.Err()
+			}
+			return resolveImageURLs(candidates, base), nil
+		case html.TextToken:
+			if inStyle {
+				candidates = append(candidates, backgroundImageURLs(string(tokenizer.Text()))...)
+			}
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "style" {
+				inStyle = false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			attrs := make(map[string]string, len(token.Attr))
+			for _, attr := range token.Attr {
+				attrs[attr.Key] = attr.Val
+			}
+
+			switch token.Data {
+			case "base":
+				if href, ok := attrs["href"]; ok {
+					if resolved, err := base.Parse(strings.TrimSpace(href)); err == nil {
+						base = resolved
+					}
+				}
+			case "img":
+				if srcset := largestSrcsetCandidate(attrs["srcset"]); srcset != "" {
+					candidates = append(candidates, srcset)
+				} else if src := attrs["src"]; src != "" {
+					candidates = append(candidates, src)
+				}
+			case "source":
+				// The srcset of a picture source, a video or audio source has a src
+				if srcset := largestSrcsetCandidate(attrs["srcset"]); srcset != "" {
+					candidates = append(candidates, srcset)
+				}
+			case "meta":
+				property := strings.ToLower(attrs["property"])
+				if property == "" {
+					property = strings.ToLower(attrs["name"])
+				}
+				if ogImageProperties[property] && attrs["content"] != "" {
+					candidates = append(candidates, attrs["content"])
+				}
+			case "style":
+				inStyle = token.Type == html.StartTagToken
+			}
+
+			if style, ok := attrs["style"]; ok {
+				candidates = append(candidates, backgroundImageURLs(style)...)
+			}
+		}
+	}
+}
+
+// resolveImageURLs resolves the candidates against base, dropping the ones that
+// aren't http or https URLs, like data: URIs, and duplicates.
+func resolveImageURLs(candidates []string, base *url.URL) []string {
+	var imageURLs []string
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		resolved, err := base.Parse(strings.TrimSpace(candidate))
+		if err != nil {
+			continue
+		}
+		resolved.Fragment = ""
+
+		imageURL := resolved.String()
+		if seen[imageURL] || validateImageURL(imageURL) != nil {
+			continue
+		}
+		seen[imageURL] = true
+		imageURLs = append(imageURLs, imageURL)
+	}
+
+	return imageURLs
+}
+
+// largestSrcsetCandidate returns the URL of the largest image of a srcset: the
+// widest for width descriptors, otherwise the one with the highest density.
+func largestSrcsetCandidate(srcset string) string {
+	var best string
+	var bestWidth, bestDensity float64
+	for _, candidate := range splitSrcset(srcset) {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+
+		width, density := 0.0, 1.0
+		if len(fields) > 1 {
+			descriptor := strings.ToLower(fields[1])
+			value, err := strconv.ParseFloat(descriptor[:len(descriptor)-1], 64)
+			switch {
+			case err != nil:
+				continue
+			case strings.HasSuffix(descriptor, "w"):
+				width = value
+			case strings.HasSuffix(descriptor, "x"):
+				density = value
+			default:
+				continue
+			}
+		}
+
+		if best == "" || width > bestWidth || (width == bestWidth && density > bestDensity) {
+			best, bestWidth, bestDensity = fields[0], width, density
+		}
+	}
+
+	return best
+}
+
+// splitSrcset splits a srcset into its candidates. Commas separate candidates
+// only when they follow whitespace or a descriptor, as URLs may contain them.
+func splitSrcset(srcset string) []string {
+	var candidates []string
+	for {
+		srcset = strings.TrimLeft(srcset, " \t\n\r\f,")
+		if srcset == "" {
+			return candidates
+		}
+
+		// The URL runs up to whitespace, the descriptors up to the next comma
+		end := strings.IndexAny(srcset, " \t\n\r\f")
+		if end < 0 {
+			candidates = append(candidates, strings.TrimRight(srcset, ","))
+			return candidates
+		}
+		if strings.HasSuffix(srcset[:end], ",") {
+			candidates = append(candidates, strings.TrimRight(srcset[:end], ","))
+			srcset = srcset[end:]
+			continue
+		}
+
+		comma := strings.IndexByte(srcset[end:], ',')
+		if comma < 0 {
+			candidates = append(candidates, srcset)
+			return candidates
+		}
+		candidates = append(candidates, srcset[:end+comma])
+		srcset = srcset[end+comma+1:]
+	}
+}
+
+// backgroundImageURLs returns the url() references of the background and
+// background-image declarations of a piece of CSS.
+func backgroundImageURLs(css string) []string {
+	var imageURLs []string
+	for _, declaration := range backgroundImage.FindAllStringSubmatch(css, -1) {
+		for _, match := range cssURL.FindAllStringSubmatch(declaration[1], -1) {
+			if imageURL := match[1] + match[2] + match[3]; imageURL != "" {
+				imageURLs = append(imageURLs, imageURL)
+			}
+		}
+	}
+
+	return imageURLs
+}
+
+// pageStream replaces the page URLs of a stream with the images on the pages.
+// A page that can't be fetched fails the run, or with a report, is recorded in
+// the report and skipped.
+type pageStream struct {
+	ctx       context.Context
+	source    ImageRequestStream
+	extractor PageExtractor
+	report    *FailureReport
+
+	pending []ImageRequest
+
+	// Pages and Failed count the pages read and the pages that failed.
+	Pages  int
+	Failed int
+}
+
+func newPageStream(ctx context.Context, source ImageRequestStream, extractor PageExtractor, report *FailureReport) *pageStream {
+	return &pageStream{ctx: ctx, source: source, extractor: extractor, report: report}
+}
+
+func (s *pageStream) Next() (ImageRequest, error) {
+	for len(s.pending) == 0 {
+		page, err := s.source.Next()
+		if err != nil {
+			return page, err
+		}
+
+		imageURLs, err := s.extractor.ExtractImageURLs(s.ctx, page)
+		s.Pages++
+		if err != nil {
+			s.Failed++
+			if s.report == nil || s.ctx.Err() != nil {
+				return ImageRequest{}, fmt.Errorf("%s: %w", page.URL, err)
+			}
+			log.Printf("Skipping page %s: %v", page.URL, err)
+			if err := s.report.Write([]DownloadResult{{URL: page.URL, Err: err}}); err != nil {
+				return ImageRequest{}, fmt.Errorf("failed to write failed URL report: %v", err)
+			}
+			continue
+		}
+		log.Printf("Found %d images on %s", len(imageURLs), page.URL)
+
+		for _, imageURL := range imageURLs {
+			s.pending = append(s.pending, pageImageRequest(page, imageURL))
+		}
+	}
+
+	req := s.pending[0]
+	s.pending = s.pending[1:]
+	return req, nil
+}
+
+func (s *pageStream) Close() error {
+	return s.source.Close()
+}
+
+// pagesFailed returns the number of pages that failed, none without pages.
+func pagesFailed(pages *pageStream) int {
+	if pages == nil {
+		return 0
+	}
+	return pages.Failed
+}
+
+// pageImageRequest makes the request for an image found on a page. It keeps
+// the options of the page request that make sense for each of its images and
+// sends the page as the Referer, as galleries often expect.
+func pageImageRequest(page ImageRequest, imageURL string) ImageRequest {
+	headers := make(map[string]string, len(page.Headers)+1)
+	for name, value := range page.Headers {
+		headers[name] = value
+	}
+	if _, ok := page.Header()["Referer"]; !ok {
+		headers["Referer"] = page.URL
+	}
+
+	return ImageRequest{
+		URL:      imageURL,
+		Subdir:   page.Subdir,
+		Headers:  headers,
+		MaxSize:  page.MaxSize,
+		Priority: page.Priority,
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractImageURLs(t *testing.T) {
+	page := `<!DOCTYPE html>
+<html>
+<head>
+	<meta property="og:image" content="/og.jpg">
+	<meta name="twitter:image" content="/twitter.jpg">
+	<style>
+		.hero { background-image: url("hero.jpg"); color: red }
+		.logo { background: #fff url(logo.png) no-repeat; }
+	</style>
+</head>
+<body>
+	<img src="thumb.jpg">
+	<img src="small.jpg" srcset="small.jpg 400w, large.jpg 1600w, medium.jpg 800w">
+	<img srcset="one.jpg, two.jpg 2x">
+	<picture>
+		<source srcset="wide.webp 1200w, narrow.webp 600w" type="image/webp">
+		<img src="fallback.jpg">
+	</picture>
+	<div style="background-image: url('tile.png')"></div>
+	<img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=">
+	<img src="thumb.jpg#again">
+	<img src="https://cdn.example.com/absolute.jpg">
+</body>
+</html>`
+	base, _ := url.Parse("https://example.com/gallery/index.html")
+
+	imageURLs, err := extractImageURLs(strings.NewReader(page), base)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"https://example.com/og.jpg",
+		"https://example.com/gallery/hero.jpg",
+		"https://example.com/gallery/logo.png",
+		"https://example.com/gallery/thumb.jpg",
+		"https://example.com/gallery/large.jpg",
+		"https://example.com/gallery/two.jpg",
+		"https://example.com/gallery/wide.webp",
+		"https://example.com/gallery/fallback.jpg",
+		"https://example.com/gallery/tile.png",
+		"https://cdn.example.com/absolute.jpg",
+	}, imageURLs)
+}
+
+func TestExtractImageURLs_BaseHref(t *testing.T) {
+	base, _ := url.Parse("https://example.com/gallery/")
+
+	imageURLs, err := extractImageURLs(strings.NewReader(`<base href="https://static.example.com/img/"><img src="a.jpg">`), base)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://static.example.com/img/a.jpg"}, imageURLs)
+}
+
+func TestLargestSrcsetCandidate(t *testing.T) {
+	assert.Equal(t, "b.jpg", largestSrcsetCandidate("a.jpg 1x, b.jpg 3x, c.jpg 2x"))
+	assert.Equal(t, "b.jpg", largestSrcsetCandidate("a.jpg 100w,b.jpg 300w"))
+	assert.Equal(t, "https://example.com/img,w_800.jpg", largestSrcsetCandidate(
+		"https://example.com/img,w_400.jpg 400w, https://example.com/img,w_800.jpg 800w"))
+	assert.Equal(t, "a.jpg", largestSrcsetCandidate("a.jpg"))
+	assert.Equal(t, "", largestSrcsetCandidate(" , "))
+}
+
+func TestHTMLPageExtractor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gallery":
+			http.Redirect(w, r, "/galleries/1/", http.StatusFound)
+		case "/galleries/1/":
+			if r.Header.Get("Cookie") != "session=1" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<img src="a.jpg"><img src="/b.jpg">`))
+		case "/image.jpg":
+			w.Header().Set("Content-Type", "image/jpeg")
+			w.Write([]byte("not a page"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	extractor := NewHTMLPageExtractor(NewStandardHTTPClient())
+	imageURLs, err := extractor.ExtractImageURLs(context.Background(), ImageRequest{
+		URL:     server.URL + "/gallery",
+		Headers: map[string]string{"Cookie": "session=1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{server.URL + "/galleries/1/a.jpg", server.URL + "/b.jpg"}, imageURLs)
+
+	_, err = extractor.ExtractImageURLs(context.Background(), ImageRequest{URL: server.URL + "/missing"})
+	var statusErr *HTTPStatusError
+	assert.True(t, errors.As(err, &statusErr))
+
+	_, err = extractor.ExtractImageURLs(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"})
+	assert.ErrorContains(t, err, "not an HTML page but image/jpeg")
+}
+
+func TestPageImageRequest(t *testing.T) {
+	page := ImageRequest{
+		URL:      "https://example.com/gallery",
+		Filename: "gallery.html",
+		Subdir:   "cats",
+		SHA256:   strings.Repeat("a", 64),
+		Headers:  map[string]string{"Cookie": "session=1"},
+		MaxSize:  1024,
+		Priority: 2,
+	}
+
+	req := pageImageRequest(page, "https://example.com/a.jpg")
+	assert.Equal(t, ImageRequest{
+		URL:      "https://example.com/a.jpg",
+		Subdir:   "cats",
+		Headers:  map[string]string{"Cookie": "session=1", "Referer": "https://example.com/gallery"},
+		MaxSize:  1024,
+		Priority: 2,
+	}, req)
+
+	page.Headers = map[string]string{"referer": "https://example.com/"}
+	req = pageImageRequest(page, "https://example.com/a.jpg")
+	assert.Equal(t, map[string]string{"referer": "https://example.com/"}, req.Headers)
+}
+
+// stubPageExtractor returns the images of each page, or fails for the pages
+// it doesn't know.
+type stubPageExtractor map[string][]string
+
+func (e stubPageExtractor) ExtractImageURLs(ctx context.Context, page ImageRequest) ([]string, error) {
+	imageURLs, ok := e[page.URL]
+	if !ok {
+		return nil, &HTTPStatusError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+	}
+	return imageURLs, nil
+}
+
+func TestDownloadImages_HTMLPages(t *testing.T) {
+	urlFile := createTempFile(t, []byte("https://example.com/page1\nhttps://example.com/missing\nhttps://example.com/page2\n"))
+	defer os.Remove(urlFile)
+	extractor := stubPageExtractor{
+		"https://example.com/page1": {"https://example.com/a.jpg", "https://example.com/b.jpg"},
+		"https://example.com/page2": {"https://example.com/b.jpg", "https://example.com/c.jpg"},
+	}
+
+	for _, failFast := range []bool{false, true} {
+		downloader := &recordingDownloader{}
+		helper := NewHelper(downloader, NewDefaultURLReader(), &stubImageSizeChecker{}, NewDefaultFileChecker(),
+			nil, NewDefaultWaitTimeGenerator(), extractor, nil)
+		tempDir := t.TempDir()
+		config := &Config{
+			ImageURLFiles:     []string{urlFile},
+			InputURLType:      InputURLHTML,
+			DedupeURLs:        true,
+			DownloadDirectory: tempDir,
+			BatchSize:         2,
+			MaxImageSize:      -1,
+			FailFast:          failFast,
+			FailedURLFile:     filepath.Join(tempDir, "failed_urls.txt"),
+		}
+
+		err := helper.DownloadImages(context.Background(), config)
+		if failFast {
+			assert.ErrorContains(t, err, "https://example.com/missing: status: 404 Not Found")
+			assert.Equal(t, []string{"https://example.com/a.jpg", "https://example.com/b.jpg"}, downloader.urls)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"https://example.com/a.jpg", "https://example.com/b.jpg", "https://example.com/c.jpg"}, downloader.urls)
+		requests, err := readAllImageRequests(NewDefaultURLReader(), config.FailedURLFile)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"https://example.com/missing"}, requestURLs(requests))
+	}
+}
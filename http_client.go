@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"time"
 )
 
 type HTTPClient interface {
-	Get(url string) (*http.Response, error)
+	Get(ctx context.Context, url string) (*http.Response, error)
+	Do(req *http.Request) (*http.Response, error)
 }
 
 type StandardHTTPClient struct {
@@ -14,13 +16,29 @@ type StandardHTTPClient struct {
 }
 
 func NewStandardHTTPClient() *StandardHTTPClient {
+	return NewStandardHTTPClientWithTimeout(10 * time.Second)
+}
+
+// NewStandardHTTPClientWithTimeout creates a client whose requests, including
+// reading the response body, are aborted after timeout. A zero timeout means
+// no limit.
+func NewStandardHTTPClientWithTimeout(timeout time.Duration) *StandardHTTPClient {
 	return &StandardHTTPClient{
 		client: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout: timeout,
 		},
 	}
 }
 
-func (c *StandardHTTPClient) Get(url string) (*http.Response, error) {
-	return c.client.Get(url)
+func (c *StandardHTTPClient) Get(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.client.Do(req)
+}
+
+func (c *StandardHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return c.client.Do(req)
 }
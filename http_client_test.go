@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/golang/mock/gomock"
 	"net/http"
 	"os"
@@ -11,8 +12,8 @@ type MockStandardHTTPClient struct {
 	client HTTPClient
 }
 
-func (m *MockStandardHTTPClient) Get(url string) (*http.Response, error) {
-	return m.client.Get(url)
+func (m *MockStandardHTTPClient) Get(ctx context.Context, url string) (*http.Response, error) {
+	return m.client.Get(ctx, url)
 }
 
 func TestStandardHTTPClient_Get(t *testing.T) {
@@ -25,13 +26,13 @@ func TestStandardHTTPClient_Get(t *testing.T) {
 	}
 
 	mockHTTPClient := NewMockHTTPClient(ctrl)
-	mockHTTPClient.EXPECT().Get(gomock.Any()).Return(mockResponse, nil)
+	mockHTTPClient.EXPECT().Get(gomock.Any(), gomock.Any()).Return(mockResponse, nil)
 
 	client := &MockStandardHTTPClient{
 		client: mockHTTPClient,
 	}
 
-	resp, err := client.Get("https://example.com")
+	resp, err := client.Get(context.Background(), "https://example.com")
 	if err != nil {
 		t.Errorf("Failed to make request: %v", err)
 	}
@@ -51,9 +52,9 @@ func TestMockHTTPClient_Get(t *testing.T) {
 	}
 
 	mockHTTPClient := NewMockHTTPClient(ctrl)
-	mockHTTPClient.EXPECT().Get(gomock.Any()).Return(mockResponse, nil)
+	mockHTTPClient.EXPECT().Get(gomock.Any(), gomock.Any()).Return(mockResponse, nil)
 
-	resp, err := mockHTTPClient.Get("https://example.com")
+	resp, err := mockHTTPClient.Get(context.Background(), "https://example.com")
 	if err != nil {
 		t.Errorf("Failed to make request: %v", err)
 	}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// iiifSize, iiifQualities and iiifFormats are the size, quality and format
+// parameters of the IIIF Image API that can be requested.
+var (
+	iiifSize      = regexp.MustCompile(`^\^?(max|full|\d+,|,\d+|!?\d+,\d+|pct:\d+(\.\d+)?)$`)
+	iiifQualities = []string{"default", "color", "gray", "bitonal"}
+	iiifFormats   = []string{"jpg", "png", "webp", "tif", "gif", "jp2", "pdf"}
+)
+
+// maxLabelLength bounds the length of the labels used in file names.
+const maxLabelLength = 100
+
+// IIIFURLReader reads the images of IIIF Presentation 2 and 3 manifests. For
+// every canvas it requests the image from its Image API service at the given
+// size, quality and format, or the image itself if it has no service. Images
+// are saved in a directory named after the manifest label, and named after
+// their canvas label and index.
+type IIIFURLReader struct {
+	HTTPClient  HTTPClient
+	RetryPolicy *RetryPolicy
+	// Size, Quality and Format are the parameters of the Image API requests,
+	// e.g. max, default and jpg for full/max/0/default.jpg.
+	Size    string
+	Quality string
+	Format  string
+}
+
+func NewIIIFURLReader(httpClient HTTPClient) *IIIFURLReader {
+	return &IIIFURLReader{HTTPClient: httpClient, Size: "max", Quality: "default", Format: "jpg"}
+}
+
+func (r *IIIFURLReader) OpenImageRequests(ctx context.Context, filePath string) (ImageRequestStream, error) {
+	doc, err := openDocument(ctx, r.HTTPClient, r.RetryPolicy, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open IIIF manifest: %w", err)
+	}
+
+	return r.readDocument(doc)
+}
+
+// readDocument reads an opened manifest. Manifests are small, so all of their
+// images are read up front.
+func (r *IIIFURLReader) readDocument(doc *document) (ImageRequestStream, error) {
+	defer doc.Close()
+
+	var manifest iiifManifest
+	if err := json.NewDecoder(doc).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse IIIF manifest %s: %w", doc.name, err)
+	}
+	if strings.Contains(manifest.Type+manifest.LegacyType, "Collection") {
+		return nil, fmt.Errorf("%s is a IIIF collection, list the manifests in it in image_url_file instead", doc.name)
+	}
+
+	canvases := manifest.Items
+	for _, sequence := range manifest.Sequences {
+		canvases = append(canvases, sequence.Canvases...)
+	}
+	version := 3
+	if len(manifest.Sequences) > 0 {
+		version = 2
+	}
+
+	stream := &resultStream{}
+	subdir := iiifFileName(iiifLabel(manifest.Label))
+	width := len(strconv.Itoa(len(canvases)))
+	for i, canvas := range canvases {
+		label := iiifFileName(iiifLabel(canvas.Label))
+		if label == "" {
+			label = "canvas"
+		}
+
+		for j, image := range canvas.images() {
+			imageURL, ext := r.imageURL(image, version)
+			if err := validateImageURL(imageURL); err != nil {
+				lineErr := &InputLineError{File: doc.name, Text: imageURL, Err: fmt.Errorf("canvas %d: %w", i+1, err)}
+				stream.results = append(stream.results, requestResult{err: lineErr})
+				continue
+			}
+
+			// Canvases rarely have several images, number the ones after the first
+			name := fmt.Sprintf("%0*d_%s", width, i+1, label)
+			if j > 0 {
+				name += fmt.Sprintf("_%d", j+1)
+			}
+			stream.results = append(stream.results, requestResult{req: ImageRequest{
+				URL:      imageURL,
+				Filename: name + ext,
+				Subdir:   subdir,
+			}})
+		}
+	}
+
+	return stream, nil
+}
+
+// imageURL returns the URL of the image, and the extension to save it with.
+func (r *IIIFURLReader) imageURL(image iiifResource, manifestVersion int) (string, string) {
+	for _, service := range image.services() {
+		version := service.version(manifestVersion)
+		if version == 0 {
+			continue
+		}
+
+		size := r.Size
+		// Image API 2 servers may not know max, which was added in 2.1, and
+		// Image API 3 dropped full as a size
+		if version == 2 && size == "max" {
+			size = "full"
+		} else if version == 3 && size == "full" {
+			size = "max"
+		}
+		base := strings.TrimSuffix(service.id(), "/")
+		return fmt.Sprintf("%s/full/%s/0/%s.%s", base, size, r.Quality, r.Format), "." + r.Format
+	}
+
+	return image.id(), urlExtension(image.id())
+}
+
+// iiifManifest is the part of a IIIF Presentation 2 or 3 manifest that is read.
+type iiifManifest struct {
+	Type       string          `json:"type"`
+	LegacyType string          `json:"@type"`
+	Label      json.RawMessage `json:"label"`
+	// Sequences hold the canvases in version 2
+	Sequences []struct {
+		Canvases []iiifCanvas `json:"canvases"`
+	} `json:"sequences"`
+	// Items are the canvases in version 3
+	Items []iiifCanvas `json:"items"`
+}
+
+// iiifCanvas is a canvas, which in version 2 holds image annotations and in
+// version 3 annotation pages of annotations.
+type iiifCanvas struct {
+	Label  json.RawMessage `json:"label"`
+	Images []struct {
+		Resource iiifResource `json:"resource"`
+	} `json:"images"`
+	Items []struct {
+		Items []struct {
+			Motivation string          `json:"motivation"`
+			Body       json.RawMessage `json:"body"`
+		} `json:"items"`
+	} `json:"items"`
+}
+
+// images returns the images painted on the canvas.
+func (c *iiifCanvas) images() []iiifResource {
+	var images []iiifResource
+	for _, image := range c.Images {
+		images = append(images, image.Resource)
+	}
+
+	for _, page := range c.Items {
+		for _, annotation := range page.Items {
+			if annotation.Motivation != "" && annotation.Motivation != "painting" {
+				continue
+			}
+			for _, body := range iiifBodies(annotation.Body) {
+				if body.Type == "" || body.Type == "Image" {
+					images = append(images, body)
+				}
+			}
+		}
+	}
+
+	return images
+}
+
+// iiifBodies returns the resources of an annotation body: a resource, a list of
+// them, or a choice, whose first item is the default.
+func iiifBodies(raw json.RawMessage) []iiifResource {
+	var bodies []iiifResource
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		json.Unmarshal(raw, &bodies)
+	} else {
+		var body iiifResource
+		if json.Unmarshal(raw, &body) == nil {
+			bodies = []iiifResource{body}
+		}
+	}
+
+	var resources []iiifResource
+	for _, body := range bodies {
+		if body.Type == "Choice" {
+			if len(body.Items) > 0 {
+				resources = append(resources, body.Items[0])
+			}
+			continue
+		}
+		resources = append(resources, body)
+	}
+	return resources
+}
+
+// iiifResource is an image resource, or in version 3 a choice of them.
+type iiifResource struct {
+	ID       string          `json:"id"`
+	LegacyID string          `json:"@id"`
+	Type     string          `json:"type"`
+	Service  json.RawMessage `json:"service"`
+	Items    []iiifResource  `json:"items"`
+}
+
+func (r *iiifResource) id() string {
+	if r.ID != "" {
+		return r.ID
+	}
+	return r.LegacyID
+}
+
+// services returns the services of the resource, a single one in version 2
+// and a list in version 3.
+func (r *iiifResource) services() []iiifService {
+	var services []iiifService
+	if bytes.HasPrefix(bytes.TrimSpace(r.Service), []byte("[")) {
+		json.Unmarshal(r.Service, &services)
+	} else {
+		var service iiifService
+		if json.Unmarshal(r.Service, &service) == nil {
+			services = []iiifService{service}
+		}
+	}
+	return services
+}
+
+// iiifService is a service of an image resource.
+type iiifService struct {
+	ID         string          `json:"id"`
+	LegacyID   string          `json:"@id"`
+	Type       string          `json:"type"`
+	LegacyType string          `json:"@type"`
+	Context    json.RawMessage `json:"@context"`
+	Profile    json.RawMessage `json:"profile"`
+}
+
+func (s *iiifService) id() string {
+	if s.ID != "" {
+		return s.ID
+	}
+	return s.LegacyID
+}
+
+// version returns the Image API version of the service, or 0 if it isn't an
+// image service. Without a type, context or profile telling the version, it is
+// taken to be the manifest version.
+func (s *iiifService) version(manifestVersion int) int {
+	if s.id() == "" {
+		return 0
+	}
+
+	description := strings.Join([]string{s.Type, s.LegacyType, string(s.Context), string(s.Profile)}, " ")
+	switch {
+	case strings.Contains(description, "ImageService3") || strings.Contains(description, "iiif.io/api/image/3"):
+		return 3
+	case strings.Contains(description, "ImageService2") || strings.Contains(description, "ImageService1") ||
+		strings.Contains(description, "iiif.io/api/image/2") || strings.Contains(description, "iiif.io/api/image/1"):
+		return 2
+	case s.Type != "" || s.LegacyType != "":
+		// Some other service, such as authentication
+		return 0
+	}
+	return manifestVersion
+}
+
+// iiifLabel returns the text of a label: a string or a list of strings and
+// language values in version 2, a language map in version 3. English is
+// preferred, then values without a language.
+func iiifLabel(raw json.RawMessage) string {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return text
+	}
+
+	var languageMap map[string][]string
+	if json.Unmarshal(raw, &languageMap) == nil && len(languageMap) > 0 {
+		for _, preferred := range []string{"en", "none"} {
+			if values, ok := languageMap[preferred]; ok {
+				return strings.Join(values, " ")
+			}
+		}
+		languages := make([]string, 0, len(languageMap))
+		for language := range languageMap {
+			languages = append(languages, language)
+		}
+		sort.Strings(languages)
+		return strings.Join(languageMap[languages[0]], " ")
+	}
+
+	var values []json.RawMessage
+	if json.Unmarshal(raw, &values) != nil || len(values) == 0 {
+		return ""
+	}
+	labels := make(map[string]string)
+	var first string
+	for _, value := range values {
+		var label struct {
+			Value    string `json:"@value"`
+			Language string `json:"@language"`
+		}
+		if json.Unmarshal(value, &label.Value) != nil && json.Unmarshal(value, &label) != nil {
+			continue
+		}
+		if first == "" {
+			first = label.Value
+		}
+		if _, ok := labels[label.Language]; !ok {
+			labels[label.Language] = label.Value
+		}
+	}
+	for _, preferred := range []string{"en", ""} {
+		if label, ok := labels[preferred]; ok {
+			return label
+		}
+	}
+	return first
+}
+
+// iiifFileName makes a label usable as a file or directory name, keeping at
+// most maxLabelLength characters of it.
+func iiifFileName(label string) string {
+	label = strings.Join(strings.Fields(label), " ")
+	if utf8.RuneCountInString(label) > maxLabelLength {
+		label = strings.TrimSpace(string([]rune(label)[:maxLabelLength]))
+	}
+	return sanitizeFileName(label)
+}
+
+// validIIIFImageRequest checks the size, quality and format of the iiif_* keys.
+// Empty values stand for the defaults.
+func validIIIFImageRequest(size, quality, format string) error {
+	if size != "" && !iiifSize.MatchString(size) {
+		return fmt.Errorf("invalid size %q: expected max, w,, ,h, w,h, !w,h or pct:n", size)
+	}
+	if quality != "" && !containsString(iiifQualities, quality) {
+		return fmt.Errorf("invalid quality %q: must be one of %s", quality, strings.Join(iiifQualities, ", "))
+	}
+	if format != "" && !containsString(iiifFormats, format) {
+		return fmt.Errorf("invalid format %q: must be one of %s", format, strings.Join(iiifFormats, ", "))
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const iiifManifestV2 = `{
+  "@context": "http://iiif.io/api/presentation/2/context.json",
+  "@id": "https://example.org/iiif/book1/manifest",
+  "@type": "sc:Manifest",
+  "label": [{"@value": "Livre d'heures", "@language": "fr"}, {"@value": "Book of Hours", "@language": "en"}],
+  "sequences": [{
+    "@type": "sc:Sequence",
+    "canvases": [
+      {
+        "@id": "https://example.org/iiif/book1/canvas/p1",
+        "@type": "sc:Canvas",
+        "label": "f. 1r",
+        "images": [{
+          "@type": "oa:Annotation",
+          "motivation": "sc:painting",
+          "resource": {
+            "@id": "https://images.example.org/book1/p1/full/full/0/default.jpg",
+            "@type": "dctypes:Image",
+            "service": {
+              "@context": "http://iiif.io/api/image/2/context.json",
+              "@id": "https://images.example.org/book1/p1",
+              "profile": "http://iiif.io/api/image/2/level1.json"
+            }
+          }
+        }]
+      },
+      {
+        "@id": "https://example.org/iiif/book1/canvas/p2",
+        "@type": "sc:Canvas",
+        "label": "f. 1v",
+        "images": [{
+          "@type": "oa:Annotation",
+          "motivation": "sc:painting",
+          "resource": {"@id": "https://images.example.org/book1/p2.png", "@type": "dctypes:Image"}
+        }]
+      }
+    ]
+  }]
+}`
+
+const iiifManifestV3 = `{
+  "@context": "http://iiif.io/api/presentation/3/context.json",
+  "id": "https://example.org/iiif/scroll/manifest",
+  "type": "Manifest",
+  "label": {"none": ["Scroll / Part 1"]},
+  "items": [
+    {
+      "id": "https://example.org/iiif/scroll/canvas/1",
+      "type": "Canvas",
+      "label": {"de": ["Vorderseite"], "en": ["Front"]},
+      "items": [{
+        "type": "AnnotationPage",
+        "items": [{
+          "type": "Annotation",
+          "motivation": "painting",
+          "body": {
+            "id": "https://images.example.org/scroll/1/full/max/0/default.jpg",
+            "type": "Image",
+            "service": [
+              {"id": "https://auth.example.org/login", "type": "AuthCookieService1"},
+              {"id": "https://images.example.org/scroll/1/", "type": "ImageService3", "profile": "level2"}
+            ]
+          }
+        }]
+      }]
+    },
+    {
+      "id": "https://example.org/iiif/scroll/canvas/2",
+      "type": "Canvas",
+      "items": [{
+        "type": "AnnotationPage",
+        "items": [
+          {
+            "type": "Annotation",
+            "motivation": "painting",
+            "body": {
+              "type": "Choice",
+              "items": [
+                {"id": "https://images.example.org/scroll/2-natural", "type": "Image",
+                 "service": [{"@id": "https://images.example.org/scroll/2-natural", "@type": "ImageService2"}]},
+                {"id": "https://images.example.org/scroll/2-xray", "type": "Image"}
+              ]
+            }
+          },
+          {
+            "type": "Annotation",
+            "motivation": "commenting",
+            "body": {"type": "TextualBody", "value": "Damaged"}
+          }
+        ]
+      }]
+    }
+  ]
+}`
+
+func TestIIIFURLReader_V2(t *testing.T) {
+	manifest := createTempFile(t, []byte(iiifManifestV2))
+	defer os.Remove(manifest)
+
+	requests, err := readAllImageRequests(NewIIIFURLReader(NewStandardHTTPClient()), manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{
+		{URL: "https://images.example.org/book1/p1/full/full/0/default.jpg", Filename: "1_f. 1r.jpg", Subdir: "Book of Hours"},
+		{URL: "https://images.example.org/book1/p2.png", Filename: "2_f. 1v.png", Subdir: "Book of Hours"},
+	}, requests)
+}
+
+func TestIIIFURLReader_V3(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/ld+json")
+		w.Write([]byte(iiifManifestV3))
+	}))
+	defer server.Close()
+
+	reader := NewIIIFURLReader(NewStandardHTTPClient())
+	reader.Size = "!1000,1000"
+	reader.Quality = "gray"
+	reader.Format = "png"
+	requests, err := readAllImageRequests(reader, server.URL+"/manifest")
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{
+		{URL: "https://images.example.org/scroll/1/full/!1000,1000/0/gray.png", Filename: "1_Front.png", Subdir: "Scroll _ Part 1"},
+		{URL: "https://images.example.org/scroll/2-natural/full/!1000,1000/0/gray.png", Filename: "2_canvas.png", Subdir: "Scroll _ Part 1"},
+	}, requests)
+}
+
+func TestIIIFURLReader_FullSize(t *testing.T) {
+	manifest := createTempFile(t, []byte(iiifManifestV3))
+	defer os.Remove(manifest)
+
+	// Image API 3 services are asked for max, which replaced full
+	reader := NewIIIFURLReader(NewStandardHTTPClient())
+	reader.Size = "full"
+	requests, err := readAllImageRequests(reader, manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"https://images.example.org/scroll/1/full/max/0/default.jpg",
+		"https://images.example.org/scroll/2-natural/full/full/0/default.jpg",
+	}, requestURLs(requests))
+}
+
+func TestIIIFURLReader_ReservedCharacters(t *testing.T) {
+	manifest := createTempFile(t, []byte(`{"type": "Manifest", "label": {"en": ["Codex: <Vol. 2>"]}, "items": [
+		{"type": "Canvas", "label": {"en": ["Folio 1r: recto?"]}, "items": [{"items": [{"motivation": "painting",
+			"body": {"id": "https://images.example.org/p.jpg", "type": "Image"}}]}]}]}`))
+	defer os.Remove(manifest)
+
+	requests, err := readAllImageRequests(NewIIIFURLReader(NewStandardHTTPClient()), manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{
+		{URL: "https://images.example.org/p.jpg", Filename: "1_Folio 1r_ recto_.jpg", Subdir: "Codex_ _Vol. 2_"},
+	}, requests)
+}
+
+func TestIIIFURLReader_Collection(t *testing.T) {
+	collection := createTempFile(t, []byte(`{
+  "@context": "http://iiif.io/api/presentation/3/context.json",
+  "type": "Collection",
+  "items": [{"id": "https://example.org/iiif/book1/manifest", "type": "Manifest"}]
+}`))
+	defer os.Remove(collection)
+
+	_, err := NewIIIFURLReader(NewStandardHTTPClient()).OpenImageRequests(context.Background(), collection)
+	assert.ErrorContains(t, err, "is a IIIF collection")
+}
+
+func TestIIIFURLReader_ManyCanvases(t *testing.T) {
+	var canvases []string
+	for i := 0; i < 12; i++ {
+		canvases = append(canvases, `{"type": "Canvas", "items": [{"items": [{"motivation": "painting",
+			"body": {"id": "https://images.example.org/p.jpg", "type": "Image",
+			"service": [{"id": "https://images.example.org/p", "type": "ImageService3"}]}}]}]}`)
+	}
+	manifest := createTempFile(t, []byte(`{"type": "Manifest", "items": [`+strings.Join(canvases, ",")+`]}`))
+	defer os.Remove(manifest)
+
+	requests, err := readAllImageRequests(NewIIIFURLReader(NewStandardHTTPClient()), manifest)
+	assert.NoError(t, err)
+	if assert.Len(t, requests, 12) {
+		assert.Equal(t, "01_canvas.jpg", requests[0].Filename)
+		assert.Equal(t, "12_canvas.jpg", requests[11].Filename)
+		assert.Equal(t, "", requests[0].Subdir)
+	}
+}
+
+func TestIIIFLabel(t *testing.T) {
+	for raw, want := range map[string]string{
+		`"Plate 1"`: "Plate 1",
+		`{"fr": ["Planche"], "en": ["Plate", "one"]}`: "Plate one",
+		`{"none": ["No. 1"], "fr": ["Planche"]}`:      "No. 1",
+		`{"fr": ["Planche"], "de": ["Tafel"]}`:        "Tafel",
+		`["Plate 1", "Planche 1"]`:                    "Plate 1",
+		`[{"@value": "Planche", "@language": "fr"}]`:  "Planche",
+		`null`: "",
+	} {
+		assert.Equal(t, want, iiifLabel(json.RawMessage(raw)), raw)
+	}
+}
+
+func TestValidIIIFImageRequest(t *testing.T) {
+	for _, size := range []string{"max", "full", "^max", "800,", ",600", "800,600", "!800,600", "pct:50", "pct:12.5"} {
+		assert.NoError(t, validIIIFImageRequest(size, "default", "jpg"), size)
+	}
+	assert.Error(t, validIIIFImageRequest("big", "default", "jpg"))
+	assert.Error(t, validIIIFImageRequest("max", "sepia", "jpg"))
+	assert.Error(t, validIIIFImageRequest("max", "default", "bmp"))
+}
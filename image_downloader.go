@@ -1,68 +1,537 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrFileExists is returned by DownloadImage when the image has already been
+// downloaded.
+var ErrFileExists = errors.New("file already exists")
+
+// ErrImageTooLarge is returned by DownloadImage when the image is larger than
+// the MaxImageSize.
+var ErrImageTooLarge = errors.New("image exceeds the maximum size")
+
+// ErrChecksumMismatch is returned by DownloadImage when the downloaded image
+// doesn't have the expected SHA-256 digest.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ExistingFilePolicy is what DownloadImage does when the image file already exists.
+type ExistingFilePolicy int
+
+const (
+	// SkipExisting leaves existing files alone.
+	SkipExisting ExistingFilePolicy = iota
+	// ReplaceOnSizeMismatch downloads the image again if the remote size, as
+	// reported by a HEAD request, differs from the size of the existing file.
+	ReplaceOnSizeMismatch
+	// OverwriteExisting always downloads the image again.
+	OverwriteExisting
 )
 
 type ImageDownloader struct {
 	HTTPClient  HTTPClient
 	FileChecker FileChecker
+	RetryPolicy *RetryPolicy
+
+	// MaxImageSize is the limit in bytes the downloaded body is held to. A
+	// download that crosses it is aborted and deleted. Zero or less means no
+	// limit.
+	MaxImageSize int64
+
+	// ExistingFilePolicy decides what happens to images that have already
+	// been downloaded. Comparing sizes needs the FileInfoGetter.
+	ExistingFilePolicy ExistingFilePolicy
+
+	// Images of at least SegmentThreshold bytes, according to FileInfoGetter,
+	// are downloaded in SegmentCount parallel byte ranges. A zero threshold
+	// disables segmented downloads.
+	FileInfoGetter   FileInfoGetter
+	SegmentThreshold int64
+	SegmentCount     int
+
+	// ExtensionPolicy decides whether images are given the extension of
+	// their format.
+	ExtensionPolicy ExtensionPolicy
+
+	// FilenameTemplate, if set, replaces the Filename and Subdir of the
+	// requests in deciding where images are saved.
+	FilenameTemplate *FilenameTemplate
+
+	// DownloadIndex records the URL each image file was downloaded from.
+	DownloadIndex *DownloadIndex
 }
 
-func (d *ImageDownloader) DownloadImage(url, downloadDir string) error {
-	fileName := filepath.Base(url)
-	filePath := filepath.Join(downloadDir, fileName)
+func (d *ImageDownloader) DownloadImage(ctx context.Context, req ImageRequest, downloadDir string) error {
+	values := templateValues{req: req, start: time.Now()}
+	filePath, err := d.filePath(values, downloadDir)
+	if err != nil {
+		return err
+	}
+
+	// A template naming the image after the response or its content is only
+	// filled in once the image is downloaded
+	deferred := d.FilenameTemplate != nil && d.FilenameTemplate.NeedsResponse()
+
+	// Check if the file already exists, possibly with the extension of its format
+	var info *RemoteFileInfo
+	var existing string
+	if !deferred {
+		existing = d.existingFilePath(filePath, req.URL)
+	}
+	if existing != "" {
+		var replace bool
+		info, replace = d.shouldReplace(ctx, req, existing)
+		if !replace {
+			// File already exists, skip downloading
+			return ErrFileExists
+		}
+	}
+
+	if !deferred {
+		// Don't download over the file of another URL
+		filePath, err = d.claimPath(filePath, req.URL, true)
+		if err != nil {
+			return err
+		}
+		defer d.DownloadIndex.release(filePath, req.URL)
+	}
+
+	if dir := filepath.Dir(filePath); dir != filepath.Clean(downloadDir) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create subdirectory: %v", err)
+		}
+	}
 
-	// Check if the file already exists
-	if d.FileChecker.IsFileExists(filePath) {
-		// File already exists, skip downloading
-		return nil
+	if info == nil && d.SegmentThreshold > 0 && d.FileInfoGetter != nil {
+		info, _ = d.FileInfoGetter.GetImageFileInfo(ctx, req.URL, req.Header())
+	}
+	if limit := req.SizeLimit(d.MaxImageSize); limit > 0 && info != nil && info.Size > limit {
+		return errTooLarge(req.URL, limit)
 	}
 
-	// Create the file
-	file, err := os.Create(filePath)
+	if info != nil && d.shouldSegment(info) {
+		values.header = info.Header
+		err = d.fetchSegmented(ctx, req, filePath, info)
+	} else {
+		err = d.RetryPolicy.Do(ctx, "download "+req.URL, func() error {
+			var err error
+			values.header, err = d.fetch(ctx, req, filePath)
+			return err
+		})
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+		return err
 	}
-	defer file.Close()
 
-	// Download the image
-	resp, err := d.HTTPClient.Get(url)
+	values.file = filePath
+	if deferred {
+		return d.moveToTemplatePath(values, downloadDir)
+	}
+	imagePath := d.ExtensionPolicy.imagePath(filePath, filePath, values.header, req.URL)
+	if imagePath != filePath {
+		imagePath, err = d.claimPath(imagePath, req.URL, false)
+		if err != nil {
+			os.Remove(filePath)
+			return err
+		}
+		defer d.DownloadIndex.release(imagePath, req.URL)
+	}
+	if imagePath != filePath {
+		if err := os.Rename(filePath, imagePath); err != nil {
+			return fmt.Errorf("failed to rename image to %s: %v", filepath.Base(imagePath), err)
+		}
+	}
+	d.recordDownload(imagePath, req.URL)
+	return nil
+}
+
+// recordDownload adds the image file to the download index. The image is there
+// either way, so a failure is only logged.
+func (d *ImageDownloader) recordDownload(filePath, url string) {
+	if err := d.DownloadIndex.record(filePath, url); err != nil {
+		log.Printf("Failed to record %s in the download index: %v", filePath, err)
+	}
+}
+
+// existingFilePath returns the file the image of url was saved to, if it
+// exists, and else "". That is filePath, or the path the ExtensionPolicy or a
+// collision may have given an image downloaded to it, as long as the
+// DownloadIndex has it down for url. A file at filePath without a record, from
+// before the index, also counts.
+func (d *ImageDownloader) existingFilePath(filePath, url string) string {
+	digest := urlDigest(url)
+	for _, candidate := range d.ExtensionPolicy.candidatePaths(filePath) {
+		for _, path := range append([]string{candidate}, hashSuffixedPaths(candidate, digest)...) {
+			if owned, _ := d.DownloadIndex.owns(path, url); owned && d.FileChecker.IsFileExists(path) {
+				return path
+			}
+		}
+	}
+	if _, known := d.DownloadIndex.owns(filePath, url); !known && d.FileChecker.IsFileExists(filePath) {
+		return filePath
+	}
+	return ""
+}
+
+// claimPath reserves filePath in the DownloadIndex for url and returns it, if
+// it is free or already url's. Otherwise it does the same with the names with
+// the hash of the URL added that colliding images get. A file without a record
+// is only taken over if unrecorded is set. The reservation lasts until the
+// download is recorded or released.
+func (d *ImageDownloader) claimPath(filePath, url string, unrecorded bool) (string, error) {
+	if d.canClaim(filePath, url, unrecorded) {
+		return filePath, nil
+	}
+	for _, path := range hashSuffixedPaths(filePath, urlDigest(url)) {
+		if d.canClaim(path, url, false) {
+			log.Printf("Saving %s as %s, %s is taken by another URL", url, filepath.Base(path), filepath.Base(filePath))
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find a free name for %s in %s", url, filepath.Dir(filePath))
+}
+
+// canClaim tells whether filePath can be given to url, and reserves it if so.
+func (d *ImageDownloader) canClaim(filePath, url string, unrecorded bool) bool {
+	owned, known := d.DownloadIndex.owns(filePath, url)
+	switch {
+	case owned:
+		return true
+	case known:
+		return false
+	case !unrecorded && d.FileChecker.IsFileExists(filePath):
+		return false
+	}
+	return d.DownloadIndex.reserve(filePath, url)
+}
+
+// hashSuffixedPaths returns the paths filePath is given when it collides with
+// the file of another URL, with longer and longer parts of the hex digest of
+// the URL.
+func hashSuffixedPaths(filePath, digest string) []string {
+	var paths []string
+	for length := 8; length <= len(digest); length *= 2 {
+		paths = append(paths, filepath.Join(filepath.Dir(filePath), digestSuffixedName(filepath.Base(filePath), digest, length)))
+	}
+	return paths
+}
+
+// filePath returns where req is saved, according to the FilenameTemplate if
+// there is one. If the template needs the response, it returns the path the
+// image is downloaded to before it is moved into place.
+func (d *ImageDownloader) filePath(values templateValues, downloadDir string) (string, error) {
+	switch {
+	case d.FilenameTemplate == nil:
+		return imageFilePath(values.req, downloadDir)
+	case d.FilenameTemplate.NeedsResponse():
+		// Named after the URL, so an interrupted download can be resumed
+		return filepath.Join(downloadDir, hashSuffixedName(".download", values.req.URL, 16)), nil
+	}
+
+	name, err := d.FilenameTemplate.Render(values)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(downloadDir, filepath.FromSlash(name)), nil
+}
+
+// moveToTemplatePath moves the image downloaded to values.file to the path the
+// FilenameTemplate gives it. An image of the same URL already there is kept or
+// replaced according to the ExistingFilePolicy, comparing the sizes of the two
+// files when asked to; the file of another URL is left alone, and the image
+// gets the hash of its URL added to its name.
+func (d *ImageDownloader) moveToTemplatePath(values templateValues, downloadDir string) error {
+	name, err := d.FilenameTemplate.Render(values)
+	if err != nil {
+		os.Remove(values.file)
+		return err
+	}
+	rendered := filepath.Join(downloadDir, filepath.FromSlash(name))
+	filePath := d.ExtensionPolicy.imagePath(rendered, values.file, values.header, values.req.URL)
+	filePath, err = d.claimPath(filePath, values.req.URL, filePath == rendered)
+	if err != nil {
+		os.Remove(values.file)
+		return err
+	}
+	defer d.DownloadIndex.release(filePath, values.req.URL)
+
+	if d.FileChecker.IsFileExists(filePath) && !d.replaceWith(filePath, values.file) {
+		os.Remove(values.file)
+		return ErrFileExists
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		os.Remove(values.file)
+		return fmt.Errorf("failed to create subdirectory: %v", err)
+	}
+	if err := os.Rename(values.file, filePath); err != nil {
+		os.Remove(values.file)
+		return fmt.Errorf("failed to move image into place: %v", err)
+	}
+	d.recordDownload(filePath, values.req.URL)
+
+	return nil
+}
+
+// replaceWith decides, according to the ExistingFilePolicy, whether the
+// existing filePath is replaced with the downloaded file.
+func (d *ImageDownloader) replaceWith(filePath, downloaded string) bool {
+	switch d.ExistingFilePolicy {
+	case OverwriteExisting:
+		return true
+	case ReplaceOnSizeMismatch:
+		existing, err := os.Stat(filePath)
+		if err != nil {
+			return true
+		}
+		replacement, err := os.Stat(downloaded)
+		return err == nil && replacement.Size() != existing.Size()
+	default:
+		return false
+	}
+}
+
+// imageFilePath returns where req is saved: under its Subdir of downloadDir,
+// named after its Filename or else the last element of its URL.
+func imageFilePath(req ImageRequest, downloadDir string) (string, error) {
+	fileName := urlFileName(req.URL)
+	if req.Filename != "" {
+		fileName = req.Filename
+		if fileName != filepath.Base(fileName) || fileName == "." || fileName == ".." {
+			return "", fmt.Errorf("invalid filename %q: must not contain a directory", req.Filename)
+		}
+	}
+
+	dir := downloadDir
+	if req.Subdir != "" {
+		subdir := filepath.Clean(filepath.FromSlash(req.Subdir))
+		if filepath.IsAbs(subdir) || subdir == ".." || strings.HasPrefix(subdir, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("invalid subdir %q: must stay inside the download directory", req.Subdir)
+		}
+		dir = filepath.Join(downloadDir, subdir)
+	}
+
+	return filepath.Join(dir, fileName), nil
+}
+
+// shouldReplace decides, according to the ExistingFilePolicy, whether the
+// already downloaded filePath is downloaded again. It returns the remote file
+// info if it had to be looked up.
+func (d *ImageDownloader) shouldReplace(ctx context.Context, req ImageRequest, filePath string) (*RemoteFileInfo, bool) {
+	switch d.ExistingFilePolicy {
+	case OverwriteExisting:
+		return nil, true
+	case ReplaceOnSizeMismatch:
+		if d.FileInfoGetter == nil {
+			return nil, false
+		}
+
+		localInfo, err := os.Stat(filePath)
+		if err != nil {
+			return nil, true
+		}
+
+		info, err := d.FileInfoGetter.GetImageFileInfo(ctx, req.URL, req.Header())
+		if err != nil {
+			log.Printf("Keeping %s, failed to compare it with %s: %v", filePath, req.URL, err)
+			return nil, false
+		}
+		if info.Size == localInfo.Size() {
+			return info, false
+		}
+
+		log.Printf("Replacing %s, its size %d differs from the remote size %d", filePath, localInfo.Size(), info.Size)
+		return info, true
+	default:
+		return nil, false
+	}
+}
+
+// fetch downloads the image into a .part file next to filePath and renames it
+// into place once the transfer is complete and synced to disk. If the server
+// supports range requests, a failed transfer keeps the .part file and the next
+// fetch only requests the missing bytes. It returns the response header.
+func (d *ImageDownloader) fetch(ctx context.Context, req ImageRequest, filePath string) (header http.Header, err error) {
+	url := req.URL
+	part := loadPartialDownload(filePath, url)
+
+	resp, err := d.request(ctx, req, part)
+	if err != nil && part.size > 0 && isRangeNotSatisfiable(err) {
+		// The part file doesn't fit the remote image anymore, start over
+		part.remove()
+		resp, err = d.request(ctx, req, part)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to download image: %v", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	// Check if the response status is OK
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download image, status: %s", resp.Status)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if resp.StatusCode == http.StatusPartialContent {
+		first, _, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || first != part.size {
+			part.remove()
+			return nil, fmt.Errorf("failed to resume download at byte %d: unexpected Content-Range %q",
+				part.size, resp.Header.Get("Content-Range"))
+		}
+		log.Printf("Resuming download of %s at byte %d", url, part.size)
+	} else {
+		if part.size > 0 {
+			log.Printf("Restarting download of %s, the image changed or can't be resumed", url)
+		}
+		part.remove()
+		part = newPartialDownload(filePath, url, resp.Header)
+		if part.resumable() {
+			if err := part.save(); err != nil {
+				return nil, fmt.Errorf("failed to save download state: %v", err)
+			}
+		}
+		flags |= os.O_TRUNC
 	}
 
-	// Copy the response body to the file
-	_, err = io.Copy(file, resp.Body)
+	// Don't even start on an image that announces it is too large
+	offset := part.size
+	limit := req.SizeLimit(d.MaxImageSize)
+	if limit > 0 && resp.ContentLength >= 0 && offset+resp.ContentLength > limit {
+		part.remove()
+		return nil, errTooLarge(url, limit)
+	}
+
+	file, err := os.OpenFile(part.path, flags, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to save image: %v", err)
+		return nil, fmt.Errorf("failed to create file: %v", err)
 	}
+	defer func() {
+		file.Close()
+		// Keep what we have only if the rest can be requested later
+		if err != nil && !part.resumable() {
+			part.remove()
+		}
+	}()
 
-	return nil
+	// Copy the response body to the part file. With a size limit, read one
+	// byte past it to tell an image of exactly the limit from a larger one.
+	body := io.Reader(resp.Body)
+	if limit > 0 {
+		body = io.LimitReader(resp.Body, limit-offset+1)
+	}
+	written, err := io.Copy(file, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save image: %w", err)
+	}
+	if limit > 0 && offset+written > limit {
+		part.remove()
+		return nil, errTooLarge(url, limit)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return nil, fmt.Errorf("failed to save image: got %d of %d bytes: %w", written, resp.ContentLength, io.ErrUnexpectedEOF)
+	}
+
+	if err = commitPartFile(file, filePath, req); err != nil {
+		part.remove()
+		return nil, err
+	}
+	os.Remove(part.metaPath())
+
+	return resp.Header, nil
 }
 
-func batchImageURLs(imageURLs []string, batchSize int) [][]string {
-	var batches [][]string
-	length := len(imageURLs)
+// commitPartFile syncs and closes the completely downloaded .part file, checks
+// it against the expected checksum of req, if any, and moves it to filePath.
+func commitPartFile(file *os.File, filePath string, req ImageRequest) error {
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync image: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close image: %v", err)
+	}
 
-	for i := 0; i < length; i += batchSize {
-		end := i + batchSize
-		if end > length {
-			end = length
+	if req.SHA256 != "" {
+		if err := verifySHA256(file.Name(), req.SHA256); err != nil {
+			return err
 		}
-		batch := imageURLs[i:end]
-		batches = append(batches, batch)
 	}
 
-	return batches
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to move image into place: %v", err)
+	}
+
+	return nil
+}
+
+// verifySHA256 checks that the SHA-256 digest of the file is the expected hex digest.
+func verifySHA256(filePath, expected string) error {
+	actual, err := fileSHA256(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to verify image: %v", err)
+	}
+
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("%w: expected sha256 %s, got %s", ErrChecksumMismatch, expected, actual)
+	}
+
+	return nil
+}
+
+// request issues the GET for the image, asking only for the bytes missing from
+// part if it can be resumed. The response is either 200 or 206.
+func (d *ImageDownloader) request(ctx context.Context, imageReq ImageRequest, part *partialDownload) (*http.Response, error) {
+	req, err := newImageRequest(ctx, imageReq)
+	if err != nil {
+		return nil, err
+	}
+
+	resuming := part.size > 0 && part.resumable()
+	if resuming {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", part.size))
+		req.Header.Set("If-Range", part.validator())
+	}
+
+	// Download the image
+	resp, err := d.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+
+	// Check if the response status is OK
+	if resp.StatusCode != http.StatusOK && !(resuming && resp.StatusCode == http.StatusPartialContent) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download image, %w", &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	return resp, nil
+}
+
+// newImageRequest creates the GET request for the image, with the extra
+// headers the input asked for.
+func newImageRequest(ctx context.Context, imageReq ImageRequest) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageReq.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	for name, value := range imageReq.Headers {
+		req.Header.Set(name, value)
+	}
+
+	return req, nil
+}
+
+func errTooLarge(url string, limit int64) error {
+	return fmt.Errorf("%w: %s is larger than %d bytes", ErrImageTooLarge, url, limit)
+}
+
+func isRangeNotSatisfiable(err error) bool {
+	var statusErr *HTTPStatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestedRangeNotSatisfiable
 }
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestDownloadImage(t *testing.T) {
@@ -27,7 +34,8 @@ func TestDownloadImage(t *testing.T) {
 	imageURL := mockServer.URL + "/image.jpg"
 
 	// Download the image
-	err = downloadImage(imageURL, downloadDir)
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	err = downloader.DownloadImage(context.Background(), ImageRequest{URL: imageURL}, downloadDir)
 	if err != nil {
 		t.Fatalf("Failed to download image: %v", err)
 	}
@@ -40,6 +48,568 @@ func TestDownloadImage(t *testing.T) {
 	}
 }
 
+func TestDownloadImage_AlreadyDownloaded(t *testing.T) {
+	downloadDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(downloadDir, "image.jpg"), []byte("image data"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to create existing image: %v", err)
+	}
+
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	err = downloader.DownloadImage(context.Background(), ImageRequest{URL: "http://127.0.0.1:0/image.jpg"}, downloadDir)
+	if !errors.Is(err, ErrFileExists) {
+		t.Errorf("Expected ErrFileExists, got %v", err)
+	}
+}
+
+func TestDownloadImage_ExistingFilePolicy(t *testing.T) {
+	remote := []byte("remote image")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "image.jpg", time.Time{}, bytes.NewReader(remote))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		policy   ExistingFilePolicy
+		existing []byte
+		expected []byte
+		err      error
+	}{
+		{"skip", SkipExisting, []byte("old"), []byte("old"), ErrFileExists},
+		{"replace on size mismatch", ReplaceOnSizeMismatch, []byte("old"), remote, nil},
+		{"keep on same size", ReplaceOnSizeMismatch, []byte("same length!"), []byte("same length!"), ErrFileExists},
+		{"overwrite", OverwriteExisting, []byte("same length!"), remote, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloadDir := t.TempDir()
+			filePath := filepath.Join(downloadDir, "image.jpg")
+			if err := os.WriteFile(filePath, tt.existing, 0644); err != nil {
+				t.Fatalf("Failed to create existing image: %v", err)
+			}
+
+			downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+			downloader.FileInfoGetter = NewDefaultFileSizeGetter(NewStandardHTTPClient())
+			downloader.ExistingFilePolicy = tt.policy
+
+			err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+			if !errors.Is(err, tt.err) {
+				t.Errorf("Expected error %v, got %v", tt.err, err)
+			}
+			assertFileContent(t, filePath, tt.expected)
+		})
+	}
+}
+
+func TestDownloadImage_MaxImageSize(t *testing.T) {
+	content := []byte(strings.Repeat("x", 2048))
+
+	tests := []struct {
+		name          string
+		contentLength bool
+		maxImageSize  int64
+		err           error
+	}{
+		{"announced too large", true, 1024, ErrImageTooLarge},
+		{"streamed too large", false, 1024, ErrImageTooLarge},
+		{"exactly the limit", false, 2048, nil},
+		{"no limit", false, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentLength {
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				}
+				// Flush in pieces so the body is chunked without a Content-Length
+				for i := 0; i < len(content); i += 512 {
+					w.Write(content[i : i+512])
+					w.(http.Flusher).Flush()
+				}
+			}))
+			defer server.Close()
+
+			downloadDir := t.TempDir()
+			downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+			downloader.MaxImageSize = tt.maxImageSize
+
+			err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Expected error %v, got %v", tt.err, err)
+			}
+			if tt.err != nil {
+				assertDirEmpty(t, downloadDir)
+			} else {
+				assertFileContent(t, filepath.Join(downloadDir, "image.jpg"), content)
+			}
+		})
+	}
+}
+
+func TestDownloadImage_RequestOptions(t *testing.T) {
+	content := []byte("image data")
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	req := ImageRequest{
+		URL:      server.URL + "/image.jpg",
+		Filename: "cover.jpg",
+		Subdir:   "books/42",
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	}
+	sum := sha256.Sum256(content)
+	req.SHA256 = hex.EncodeToString(sum[:])
+
+	err := downloader.DownloadImage(context.Background(), req, downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to download image: %v", err)
+	}
+	if authorization != "Bearer token" {
+		t.Errorf("Expected the Authorization header to be sent, got %q", authorization)
+	}
+	assertFileContent(t, filepath.Join(downloadDir, "books", "42", "cover.jpg"), content)
+}
+
+func TestDownloadImage_ChecksumMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image data"))
+	}))
+	defer server.Close()
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	req := ImageRequest{URL: server.URL + "/image.jpg", SHA256: strings.Repeat("0", 64)}
+
+	err := downloader.DownloadImage(context.Background(), req, downloadDir)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+	}
+	assertDirEmpty(t, downloadDir)
+}
+
+func TestDownloadImage_RequestMaxSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 2048)))
+	}))
+	defer server.Close()
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	downloader.MaxImageSize = 1024
+
+	// The request's own limit replaces the configured one
+	err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/a.jpg", MaxSize: -1}, downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to download image without a limit: %v", err)
+	}
+	err = downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/b.jpg", MaxSize: 512}, downloadDir)
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Fatalf("Expected ErrImageTooLarge, got %v", err)
+	}
+}
+
+func TestImageFilePath_RejectsEscapes(t *testing.T) {
+	requests := []ImageRequest{
+		{URL: "https://example.com/a.jpg", Filename: "../a.jpg"},
+		{URL: "https://example.com/a.jpg", Filename: "dir/a.jpg"},
+		{URL: "https://example.com/a.jpg", Subdir: "../outside"},
+		{URL: "https://example.com/a.jpg", Subdir: "/abs"},
+	}
+
+	for _, req := range requests {
+		if _, err := imageFilePath(req, "downloads"); err == nil {
+			t.Errorf("Expected an error for %+v", req)
+		}
+	}
+}
+
+func TestDownloadImage_CancelRemovesPartialFile(t *testing.T) {
+	downloadDir := t.TempDir()
+
+	// Serve part of the body, then stall until the client goes away
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.Write(make([]byte, 512))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	err := downloader.DownloadImage(ctx, ImageRequest{URL: server.URL + "/large.jpg"}, downloadDir)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a context.Canceled error, got %v", err)
+	}
+
+	assertDirEmpty(t, downloadDir)
+}
+
+func TestDownloadImage_NonOKStatusLeavesNoFile(t *testing.T) {
+	downloadDir := t.TempDir()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/missing.jpg"}, downloadDir)
+	if err == nil {
+		t.Fatal("Expected an error for a 404 response")
+	}
+
+	assertDirEmpty(t, downloadDir)
+}
+
+func TestDownloadImage_ShortBodyLeavesNoFile(t *testing.T) {
+	downloadDir := t.TempDir()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("short"))
+	}))
+	defer server.Close()
+
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+	if err == nil {
+		t.Fatal("Expected an error for a truncated body")
+	}
+
+	assertDirEmpty(t, downloadDir)
+}
+
+func TestDownloadImage_ResumesPartFile(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 100))
+	var rangeHeader string
+	server := createFlakyRangeServer(t, func(r *http.Request) ([]byte, string) {
+		rangeHeader = r.Header.Get("Range")
+		return content, `"v1"`
+	})
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+
+	// The first attempt is cut off half way and keeps the part file
+	err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+	if err == nil {
+		t.Fatal("Expected the first download to fail")
+	}
+	partFile := filepath.Join(downloadDir, "image.jpg"+partFileSuffix)
+	if info, err := os.Stat(partFile); err != nil || info.Size() != int64(len(content)/2) {
+		t.Fatalf("Expected a part file with half of the image, got %v", err)
+	}
+
+	// The second attempt only requests the rest
+	err = downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to resume download: %v", err)
+	}
+	if rangeHeader != "bytes=500-" {
+		t.Errorf("Expected a range request for the rest of the image, got %q", rangeHeader)
+	}
+
+	assertFileContent(t, filepath.Join(downloadDir, "image.jpg"), content)
+	if entries, _ := os.ReadDir(downloadDir); len(entries) != 1 {
+		t.Errorf("Expected the part files to be cleaned up, got %d entries", len(entries))
+	}
+}
+
+func TestDownloadImage_RestartsWhenImageChanged(t *testing.T) {
+	oldContent := []byte(strings.Repeat("a", 1000))
+	newContent := []byte(strings.Repeat("b", 800))
+	version := 0
+	server := createFlakyRangeServer(t, func(r *http.Request) ([]byte, string) {
+		version++
+		if version == 1 {
+			return oldContent, `"v1"`
+		}
+		return newContent, `"v2"`
+	})
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+
+	err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+	if err == nil {
+		t.Fatal("Expected the first download to fail")
+	}
+
+	err = downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to download changed image: %v", err)
+	}
+
+	assertFileContent(t, filepath.Join(downloadDir, "image.jpg"), newContent)
+}
+
+// createFlakyRangeServer serves the content and ETag returned by image with
+// range support, cutting the connection half way through the first response.
+func TestDownloadImage_FilenameTemplate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image data"))
+	}))
+	defer server.Close()
+
+	template, err := ParseFilenameTemplate("{host}/{subdir}/{index:03}_{meta:sku}.{ext}")
+	if err != nil {
+		t.Fatalf("Failed to parse template: %v", err)
+	}
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	downloader.FilenameTemplate = template
+
+	req := ImageRequest{URL: server.URL + "/photos/a.jpg?w=100", Subdir: "catalog", Filename: "ignored.jpg",
+		Index: 7, Metadata: map[string]string{"sku": "A/100"}}
+	err = downloader.DownloadImage(context.Background(), req, downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to download image: %v", err)
+	}
+	assertFileContent(t, filepath.Join(downloadDir, "127.0.0.1", "catalog", "007_A_100.jpg"), []byte("image data"))
+
+	err = downloader.DownloadImage(context.Background(), req, downloadDir)
+	if !errors.Is(err, ErrFileExists) {
+		t.Errorf("Expected ErrFileExists, got %v", err)
+	}
+}
+
+func TestDownloadImage_FilenameTemplateAfterResponse(t *testing.T) {
+	image := []byte("image data")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", "Wed, 01 May 2024 10:00:00 GMT")
+		w.Header().Set("X-Collection", "spring")
+		w.Write(image)
+	}))
+	defer server.Close()
+
+	template, err := ParseFilenameTemplate("{header:X-Collection}/{last_modified:2006/01}/{sha256:8}.{ext}")
+	if err != nil {
+		t.Fatalf("Failed to parse template: %v", err)
+	}
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	downloader.FilenameTemplate = template
+
+	req := ImageRequest{URL: server.URL + "/image.png"}
+	err = downloader.DownloadImage(context.Background(), req, downloadDir)
+	if err != nil {
+		t.Fatalf("Failed to download image: %v", err)
+	}
+	sum := sha256.Sum256(image)
+	filePath := filepath.Join(downloadDir, "spring", "2024", "05", hex.EncodeToString(sum[:])[:8]+".png")
+	assertFileContent(t, filePath, image)
+
+	// The same image is downloaded again, but kept
+	err = downloader.DownloadImage(context.Background(), req, downloadDir)
+	if !errors.Is(err, ErrFileExists) {
+		t.Errorf("Expected ErrFileExists, got %v", err)
+	}
+
+	// Nothing is left besides the image
+	os.Remove(filePath)
+	for _, dir := range []string{"2024/05", "2024", ""} {
+		os.Remove(filepath.Join(downloadDir, "spring", dir))
+	}
+	assertDirEmpty(t, downloadDir)
+}
+
+func TestDownloadImage_ExtensionPolicy(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	webp := []byte("RIFF\x24\x00\x00\x00WEBPVP8 ")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(webp)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		policy ExtensionPolicy
+		url    string
+		saved  string
+	}{
+		{"keep", KeepExtension, "/image?id=1", "image"},
+		{"add", AddExtension, "/image?id=1", "image.png"},
+		{"add keeps image extensions", AddExtension, "/photo.jpg", "photo.jpg"},
+		{"fix", FixExtension, "/photo.jpg", "photo.webp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloadDir := t.TempDir()
+			downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+			downloader.ExtensionPolicy = tt.policy
+
+			req := ImageRequest{URL: server.URL + tt.url}
+			if err := downloader.DownloadImage(context.Background(), req, downloadDir); err != nil {
+				t.Fatalf("Failed to download image: %v", err)
+			}
+			entries, err := os.ReadDir(downloadDir)
+			if err != nil {
+				t.Fatalf("Failed to read directory: %v", err)
+			}
+			if len(entries) != 1 || entries[0].Name() != tt.saved {
+				t.Fatalf("Expected only %s in the download directory, got %v", tt.saved, entries)
+			}
+
+			// The renamed image counts as downloaded
+			err = downloader.DownloadImage(context.Background(), req, downloadDir)
+			if !errors.Is(err, ErrFileExists) {
+				t.Errorf("Expected ErrFileExists, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDownloadImage_NameCollision(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	}))
+	defer server.Close()
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	downloader.ExtensionPolicy = KeepExtension
+	urls := []string{server.URL + "/x/1.jpg", server.URL + "/y/1.jpg", server.URL + "/z/1.JPG"}
+	names := []string{"1.jpg", hashSuffixedName("1.jpg", urls[1], 8), hashSuffixedName("1.JPG", urls[2], 8)}
+
+	// The first URL to be downloaded keeps the name, names are compared
+	// ignoring case
+	for _, url := range urls {
+		req := ImageRequest{URL: url, Filename: urlFileName(url)}
+		if err := downloader.DownloadImage(context.Background(), req, downloadDir); err != nil {
+			t.Fatalf("Failed to download %s: %v", url, err)
+		}
+	}
+	for i, name := range names {
+		assertFileContent(t, filepath.Join(downloadDir, name), []byte(strings.TrimPrefix(urls[i], "http://")))
+	}
+
+	// Each URL finds its own file again, whatever the order
+	for i := len(urls) - 1; i >= 0; i-- {
+		req := ImageRequest{URL: urls[i], Filename: urlFileName(urls[i])}
+		err := downloader.DownloadImage(context.Background(), req, downloadDir)
+		if !errors.Is(err, ErrFileExists) {
+			t.Errorf("Expected ErrFileExists for %s, got %v", urls[i], err)
+		}
+	}
+}
+
+func TestDownloadImage_ExtensionCollision(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(append(png, r.URL.Path...))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		order  []string
+		policy ExistingFilePolicy
+	}{
+		{"without extension first", []string{"/photo", "/photo.png"}, SkipExisting},
+		{"with extension first", []string{"/photo.png", "/photo"}, SkipExisting},
+		{"overwrite without extension first", []string{"/photo", "/photo.png"}, OverwriteExisting},
+		{"overwrite with extension first", []string{"/photo.png", "/photo"}, OverwriteExisting},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloadDir := t.TempDir()
+			downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+			downloader.ExtensionPolicy = AddExtension
+			downloader.ExistingFilePolicy = tt.policy
+
+			// Both images are kept, whichever comes first, on every run
+			for run := 0; run < 2; run++ {
+				for _, path := range tt.order {
+					err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + path}, downloadDir)
+					if err != nil && !(run > 0 && tt.policy == SkipExisting && errors.Is(err, ErrFileExists)) {
+						t.Fatalf("Failed to download %s: %v", path, err)
+					}
+				}
+
+				entries, err := os.ReadDir(downloadDir)
+				if err != nil {
+					t.Fatalf("Failed to read directory: %v", err)
+				}
+				if len(entries) != 2 {
+					t.Fatalf("Expected 2 images in the download directory, got %v", entries)
+				}
+				first := filepath.Join(downloadDir, "photo.png")
+				second := filepath.Join(downloadDir, hashSuffixedName("photo.png", server.URL+tt.order[1], 8))
+				assertFileContent(t, first, append(png, tt.order[0]...))
+				assertFileContent(t, second, append(png, tt.order[1]...))
+			}
+		})
+	}
+}
+
+func createFlakyRangeServer(t *testing.T, image func(r *http.Request) ([]byte, string)) *httptest.Server {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		content, etag := image(r)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Accept-Ranges", "bytes")
+		if requests == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "image.jpg", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func assertFileContent(t *testing.T, filePath string, expected []byte) {
+	t.Helper()
+
+	contents, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if !bytes.Equal(contents, expected) {
+		t.Errorf("Unexpected content in %s: got %d bytes, expected %d", filePath, len(contents), len(expected))
+	}
+}
+
+func assertDirEmpty(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	for _, entry := range entries {
+		t.Errorf("Unexpected file left in %s: %s", dir, entry.Name())
+	}
+}
+
 func createMockServer() *httptest.Server {
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Serve a sample image file
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stdinPath is the image_url_file that reads the URLs from standard input.
+const stdinPath = "-"
+
+// InputLineError is a line of an input file that doesn't hold a usable image
+// request. Streams return it for the line and go on with the next one.
+type InputLineError struct {
+	File string
+	Line int
+	Text string
+	Err  error
+}
+
+func (e *InputLineError) Error() string {
+	// Formats without lines, such as JSON Feeds, leave it 0
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %v", e.File, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *InputLineError) Unwrap() error {
+	return e.Err
+}
+
+// lineStream is a stream of a line-based input that can tell the line of the
+// request it returned last.
+type lineStream interface {
+	ImageRequestStream
+	lastLine() int
+}
+
+// lastLine returns the line of the request the stream returned last, or 0 if
+// the stream doesn't know it.
+func lastLine(stream ImageRequestStream) int {
+	if lines, ok := stream.(lineStream); ok {
+		return lines.lastLine()
+	}
+	return 0
+}
+
+// openInput opens the input file, or standard input for stdinPath. Reading
+// standard input gives up when ctx is cancelled, as a pipe may stay open
+// without sending anything.
+func openInput(ctx context.Context, filePath string) (io.ReadCloser, error) {
+	if filePath == stdinPath {
+		return io.NopCloser(&contextReader{ctx: ctx, r: os.Stdin}), nil
+	}
+
+	return os.Open(filePath)
+}
+
+// contextReader reads from r until ctx is cancelled. A read still blocked then
+// is left behind, and what it reads is dropped.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Read into a buffer of our own, which nobody uses after a cancellation
+	buf := make([]byte, len(p))
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := r.r.Read(buf)
+		done <- readResult{n, err}
+	}()
+
+	select {
+	case result := <-done:
+		return copy(p, buf[:result.n]), result.err
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
+
+// inputName names the input file in error messages.
+func inputName(filePath string) string {
+	if filePath == stdinPath {
+		return "stdin"
+	}
+	return filePath
+}
+
+// expandInputs expands the glob patterns among the input files, keeping their
+// order. Paths without wildcards and URLs are kept as they are, so a missing
+// file is reported when it is opened.
+func expandInputs(patterns []string) ([]string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		if pattern == stdinPath || isRemoteInput(pattern) || !strings.ContainsAny(pattern, "*?[") {
+			paths = append(paths, pattern)
+			continue
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no image URL file given")
+	}
+
+	return paths, nil
+}
+
+// openImageRequests opens the input files with the reader as a single stream
+// that reads them one after the other.
+func openImageRequests(ctx context.Context, reader URLReader, patterns []string) (ImageRequestStream, error) {
+	paths, err := expandInputs(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &multiInputStream{ctx: ctx, reader: reader, paths: paths}
+	// Open the first file right away to fail early on a missing one
+	if err := stream.openNext(); err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// multiInputStream concatenates the requests of several input files, opening
+// each file when the previous one is done.
+type multiInputStream struct {
+	ctx     context.Context
+	reader  URLReader
+	paths   []string
+	current ImageRequestStream
+}
+
+func (s *multiInputStream) openNext() error {
+	current, err := s.reader.OpenImageRequests(s.ctx, s.paths[0])
+	if err != nil {
+		return err
+	}
+
+	s.current = current
+	s.paths = s.paths[1:]
+	return nil
+}
+
+func (s *multiInputStream) Next() (ImageRequest, error) {
+	for {
+		if s.current == nil {
+			if len(s.paths) == 0 {
+				return ImageRequest{}, io.EOF
+			}
+			if err := s.openNext(); err != nil {
+				return ImageRequest{}, err
+			}
+		}
+
+		req, err := s.current.Next()
+		if err != io.EOF {
+			return req, err
+		}
+
+		if err := s.current.Close(); err != nil {
+			return ImageRequest{}, err
+		}
+		s.current = nil
+	}
+}
+
+func (s *multiInputStream) Close() error {
+	if s.current == nil {
+		return nil
+	}
+
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenImageRequests_GlobsAndFormats(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "b.txt"), []byte("https://example.com/b.jpg\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("https://example.com/a.jpg\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "c.jsonl"), []byte(`{"url": "https://example.com/c.jpg"}`+"\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "d.csv"), []byte("url\nhttps://example.com/d.jpg\n"), 0644))
+
+	reader := NewFormatURLReader(InputFormatAuto)
+	reader.CSVColumns = CSVColumns{Header: true, URL: "url"}
+	stream, err := openImageRequests(context.Background(), reader, []string{
+		filepath.Join(dir, "d.csv"),
+		filepath.Join(dir, "*.txt"),
+		filepath.Join(dir, "c.jsonl"),
+	})
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	requests, err := drainStream(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"https://example.com/d.jpg",
+		"https://example.com/a.jpg",
+		"https://example.com/b.jpg",
+		"https://example.com/c.jpg",
+	}, requestURLs(requests))
+}
+
+func TestOpenImageRequests_Stdin(t *testing.T) {
+	stdin := createTempFile(t, []byte(`{"url": "https://example.com/a.jpg"}`+"\n"+`{"url": "https://example.com/b.jpg"}`))
+	defer os.Remove(stdin)
+	file, err := os.Open(stdin)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	oldStdin := os.Stdin
+	os.Stdin = file
+	defer func() { os.Stdin = oldStdin }()
+
+	stream, err := openImageRequests(context.Background(), NewFormatURLReader(InputFormatJSONL), []string{"-"})
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	requests, err := drainStream(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/a.jpg", "https://example.com/b.jpg"}, requestURLs(requests))
+}
+
+func TestOpenImageRequests_StdinErrorNamesStdin(t *testing.T) {
+	stdin := createTempFile(t, []byte("not json\n"))
+	defer os.Remove(stdin)
+	file, err := os.Open(stdin)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	oldStdin := os.Stdin
+	os.Stdin = file
+	defer func() { os.Stdin = oldStdin }()
+
+	stream, err := openImageRequests(context.Background(), NewManifestURLReader(), []string{"-"})
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	_, err = stream.Next()
+	assert.ErrorContains(t, err, "stdin:1:")
+}
+
+func TestDownloadImages_StdinCanceled(t *testing.T) {
+	// A pipe that stays open without sending the rest of the list
+	reader, writer, err := os.Pipe()
+	assert.NoError(t, err)
+	defer reader.Close()
+	defer writer.Close()
+	_, err = writer.WriteString("https://example.com/a.jpg\n")
+	assert.NoError(t, err)
+
+	oldStdin := os.Stdin
+	os.Stdin = reader
+	defer func() { os.Stdin = oldStdin }()
+
+	helper := NewHelper(&recordingDownloader{}, NewDefaultURLReader(), &stubImageSizeChecker{}, NewDefaultFileChecker(),
+		nil, NewDefaultWaitTimeGenerator(), nil, nil)
+	tempDir := t.TempDir()
+	config := &Config{
+		ImageURLFiles:     []string{stdinPath},
+		DownloadDirectory: tempDir,
+		BatchSize:         10,
+		MaxImageSize:      -1,
+		FailedURLFile:     filepath.Join(tempDir, "failed_urls.txt"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- helper.DownloadImages(ctx, config)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		assert.True(t, errors.Is(err, context.Canceled), "expected a cancellation, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("DownloadImages kept waiting for stdin after the cancellation")
+	}
+}
+
+func TestOpenImageRequests_MissingFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := openImageRequests(context.Background(), NewDefaultURLReader(), []string{filepath.Join(dir, "missing.txt")})
+	assert.ErrorContains(t, err, "no such file")
+
+	_, err = openImageRequests(context.Background(), NewDefaultURLReader(), []string{filepath.Join(dir, "*.txt")})
+	assert.ErrorContains(t, err, "no files match")
+
+	_, err = openImageRequests(context.Background(), NewDefaultURLReader(), nil)
+	assert.ErrorContains(t, err, "no image URL file given")
+
+	// A missing file after the first one shows up when the stream gets to it
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("https://example.com/a.jpg\n"), 0644))
+	stream, err := openImageRequests(context.Background(), NewDefaultURLReader(), []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "missing.txt")})
+	assert.NoError(t, err)
+	defer stream.Close()
+	_, err = drainStream(stream)
+	assert.ErrorContains(t, err, "no such file")
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/spf13/viper"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
+// shutdownTimeout is how long the downloads get to stop after a termination
+// signal before the process exits anyway.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	// Load the configuration
 	err := loadConfig("")
@@ -18,34 +26,96 @@ func main() {
 
 	// Print the current configuration
 	printConfig()
+	config, err := newConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Set up signal handling for graceful shutdown
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Create the HTTP client and file checker
-	httpClient := NewStandardHTTPClient()
+	retryPolicy := newRetryPolicy(config)
+	httpClient := NewStandardHTTPClientWithTimeout(time.Duration(config.HTTPTimeout * float64(time.Second)))
 	fileChecker := NewDefaultFileChecker()
-	fileSizeGetter := NewDefaultFileSizeGetter()
-	urlReader := NewDefaultURLReader()
-	imageSizeChecker := NewDefaultImageSizeChecker()
+	fileSizeGetter := NewDefaultFileSizeGetter(httpClient)
+	fileSizeGetter.RetryPolicy = retryPolicy
+	urlReader := NewFormatURLReader(config.InputFormat)
+	urlReader.CSVColumns = csvColumns(config)
+	urlReader.ExpandBraces = config.ExpandURLBraces
+	urlReader.HTTPClient = httpClient
+	urlReader.RetryPolicy = retryPolicy
+	urlReader.Sitemap = NewSitemapURLReader(httpClient)
+	urlReader.Sitemap.RetryPolicy = retryPolicy
+	urlReader.Sitemap.ModifiedSince = config.SitemapModifiedSince
+	urlReader.Feed = NewFeedURLReader(httpClient)
+	urlReader.Feed.RetryPolicy = retryPolicy
+	urlReader.Feed.MIMETypes = config.FeedMIMETypes
+	urlReader.IIIF = NewIIIFURLReader(httpClient)
+	urlReader.IIIF.RetryPolicy = retryPolicy
+	urlReader.IIIF.Size = config.IIIFSize
+	urlReader.IIIF.Quality = config.IIIFQuality
+	urlReader.IIIF.Format = config.IIIFFormat
+	var feedState *FeedState
+	if config.FeedStateFile != "" {
+		feedState, err = LoadFeedState(config.FeedStateFile)
+		if err != nil {
+			log.Fatalf("Failed to load feed state: %v", err)
+		}
+		urlReader.Feed.State = feedState
+	}
+	imageSizeChecker := NewDefaultImageSizeChecker(fileSizeGetter)
 	waitTimeGenerator := NewDefaultWaitTimeGenerator()
+	pageExtractor := NewHTMLPageExtractor(httpClient)
+	pageExtractor.RetryPolicy = retryPolicy
+	downloadIndex, err := LoadDownloadIndex(config.DownloadDirectory)
+	if err != nil {
+		log.Fatalf("Failed to load download index: %v", err)
+	}
+	defer downloadIndex.Close()
 
 	// Create the image downloader
 	imageDownloader := NewImageDownloader(httpClient, fileChecker)
+	imageDownloader.RetryPolicy = retryPolicy
+	imageDownloader.MaxImageSize = config.MaxImageSize
+	imageDownloader.FileInfoGetter = fileSizeGetter
+	imageDownloader.ExistingFilePolicy = existingFilePolicy(config)
+	imageDownloader.SegmentCount = config.SegmentCount
+	imageDownloader.SegmentThreshold = config.SegmentThreshold
+	imageDownloader.FilenameTemplate = config.FilenameTemplate
+	imageDownloader.ExtensionPolicy = config.ExtensionPolicy
+	imageDownloader.DownloadIndex = downloadIndex
 
 	// Start the image downloader
+	errCh := make(chan error, 1)
 	go func() {
-		err := startImageDownloader(imageDownloader, urlReader, imageSizeChecker, fileChecker,
-			fileSizeGetter, waitTimeGenerator)
-		if err != nil {
-			log.Fatalf("Image downloader failed: %v", err)
-		}
+		errCh <- startImageDownloader(ctx, config, imageDownloader, urlReader, imageSizeChecker, fileChecker,
+			fileSizeGetter, waitTimeGenerator, pageExtractor, downloadIndex, feedState)
 	}()
 
-	// Wait for the termination signal
-	<-signalCh
-	log.Println("Received termination signal. Shutting down...")
+	// Wait for the downloader to finish or for the termination signal. On a
+	// signal the in-flight downloads are cancelled and clean up their partial
+	// files before the downloader returns. A second signal, or a downloader
+	// that doesn't return within the shutdown timeout, ends the process.
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		stop()
+		log.Println("Received termination signal. Shutting down...")
+		select {
+		case err = <-errCh:
+		case <-time.After(shutdownTimeout):
+			log.Fatalf("Image downloader didn't stop within %v", shutdownTimeout)
+		}
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+	}
+
+	if err != nil {
+		log.Fatalf("Image downloader failed: %v", err)
+	}
 }
 
 func loadConfig(configFilePath string) error {
@@ -68,12 +138,48 @@ func loadConfig(configFilePath string) error {
 		}
 	}
 
+	viper.SetDefault("input_format", InputFormatAuto)
+	viper.SetDefault("input_url_type", InputURLImage)
+	viper.SetDefault("sitemap_modified_since", "")
+	viper.SetDefault("feed_mime_types", []string{"image/*"})
+	viper.SetDefault("feed_state_file", "feed_state.json")
+	viper.SetDefault("iiif_size", "max")
+	viper.SetDefault("iiif_quality", "default")
+	viper.SetDefault("iiif_format", "jpg")
+	viper.SetDefault("csv_header", true)
+	viper.SetDefault("csv_url_column", "url")
+	viper.SetDefault("expand_url_braces", false)
+	viper.SetDefault("normalize_urls", []string{
+		NormalizeLowercaseHost, NormalizeRemoveDefaultPort, NormalizeDropFragment, NormalizeSortQuery, NormalizeStripQueryParams,
+	})
+	viper.SetDefault("strip_query_params", []string{"utm_*"})
+	viper.SetDefault("dedupe_urls", true)
+	viper.SetDefault("priority_window", 10000)
+	viper.SetDefault("strict_input", false)
+	viper.SetDefault("rejected_lines_file", "rejected_lines.txt")
+	viper.SetDefault("filename_template", "")
+	viper.SetDefault("extension_policy", ExtensionPolicyAdd)
 	viper.SetDefault("batch_size", 2)
+	viper.SetDefault("concurrency", 0)
 	viper.SetDefault("min_wait_time", 0.8)
 	viper.SetDefault("max_wait_time", 3.0)
 	viper.SetDefault("max_image_size_mb", "MAX")
+	viper.SetDefault("size_precheck", true)
 	viper.SetDefault("replace_downloaded_file_size", false)
 	viper.SetDefault("skip_if_file_exists", true)
+	viper.SetDefault("http_timeout", 10.0)
+	viper.SetDefault("segment_threshold", "0")
+	viper.SetDefault("segment_count", 4)
+	viper.SetDefault("fail_fast", true)
+	viper.SetDefault("failed_url_file", "failed_urls.txt")
+	viper.SetDefault("retry_max_attempts", 3)
+	viper.SetDefault("retry_base_delay", 0.5)
+	viper.SetDefault("retry_max_delay", 30.0)
+	viper.SetDefault("retry_jitter", 0.5)
+	viper.SetDefault("retry_status_codes", []int{408, 425, 429, 500, 502, 503, 504})
+	viper.SetDefault("retry_network_errors", []string{
+		NetErrTimeout, NetErrConnectionReset, NetErrConnectionRefused, NetErrUnexpectedEOF,
+	})
 
 	return nil
 }
@@ -81,29 +187,175 @@ func loadConfig(configFilePath string) error {
 func printConfig() {
 	log.Println("Current Configuration:")
 	log.Println("======================")
+	log.Printf("Input Format: %s", viper.GetString("input_format"))
+	log.Printf("Input URL Type: %s", viper.GetString("input_url_type"))
+	log.Printf("Sitemap Modified Since: %s", viper.GetString("sitemap_modified_since"))
+	log.Printf("Feed MIME Types: %v", viper.GetStringSlice("feed_mime_types"))
+	log.Printf("Feed State File: %s", viper.GetString("feed_state_file"))
+	log.Printf("IIIF Image Request: full/%s/0/%s.%s", viper.GetString("iiif_size"),
+		viper.GetString("iiif_quality"), viper.GetString("iiif_format"))
+	switch viper.GetString("input_format") {
+	case InputFormatCSV, InputFormatTSV, InputFormatAuto:
+		log.Printf("CSV Header: %v", viper.GetBool("csv_header"))
+		log.Printf("CSV URL Column: %s", viper.GetString("csv_url_column"))
+		log.Printf("CSV Filename Columns: %v", viper.GetStringSlice("csv_filename_columns"))
+		log.Printf("CSV Subdir Columns: %v", viper.GetStringSlice("csv_subdir_columns"))
+	}
+	log.Printf("Expand URL Braces: %v", viper.GetBool("expand_url_braces"))
+	log.Printf("Normalize URLs: %v", viper.GetStringSlice("normalize_urls"))
+	log.Printf("Strip Query Params: %v", viper.GetStringSlice("strip_query_params"))
+	log.Printf("Dedupe URLs: %v", viper.GetBool("dedupe_urls"))
+	log.Printf("Priority Window: %d", viper.GetInt("priority_window"))
+	log.Printf("Strict Input: %v", viper.GetBool("strict_input"))
+	if !viper.GetBool("strict_input") {
+		log.Printf("Rejected Lines File: %s", viper.GetString("rejected_lines_file"))
+	}
+	log.Printf("Filename Template: %s", viper.GetString("filename_template"))
+	log.Printf("Extension Policy: %s", viper.GetString("extension_policy"))
 	log.Printf("Batch Size: %d", viper.GetInt("batch_size"))
+	log.Printf("Concurrency: %d", viper.GetInt("concurrency"))
 	log.Printf("Min Wait Time: %.2f", viper.GetFloat64("min_wait_time"))
 	log.Printf("Max Wait Time: %.2f", viper.GetFloat64("max_wait_time"))
 	log.Printf("Max Image Size: %s", viper.GetString("max_image_size_mb"))
+	log.Printf("Size Precheck: %v", viper.GetBool("size_precheck"))
 	log.Printf("Replace Downloaded File Size: %v", viper.GetBool("replace_downloaded_file_size"))
 	log.Printf("Skip If File Exists: %v", viper.GetBool("skip_if_file_exists"))
+	log.Printf("HTTP Timeout: %.2f", viper.GetFloat64("http_timeout"))
+	log.Printf("Segment Threshold: %s", viper.GetString("segment_threshold"))
+	log.Printf("Segment Count: %d", viper.GetInt("segment_count"))
+	log.Printf("Fail Fast: %v", viper.GetBool("fail_fast"))
+	if !viper.GetBool("fail_fast") {
+		log.Printf("Failed URL File: %s", viper.GetString("failed_url_file"))
+	}
+	log.Printf("Retry Max Attempts: %d", viper.GetInt("retry_max_attempts"))
+	log.Printf("Retry Delay: %.2f-%.2f (jitter %.2f)", viper.GetFloat64("retry_base_delay"),
+		viper.GetFloat64("retry_max_delay"), viper.GetFloat64("retry_jitter"))
+	log.Printf("Retry Status Codes: %v", viper.GetIntSlice("retry_status_codes"))
+	log.Printf("Retry Network Errors: %v", viper.GetStringSlice("retry_network_errors"))
 	log.Println("======================")
 }
 
-func startImageDownloader(downloader Downloader, urlReader URLReader,
-	imageSizeChecker ImageSizeChecker, fileChecker FileChecker, fileSizeGetter FileSizeGetter,
-	waitTimeGenerator WaitTimeGenerator) error {
-	config := &Config{
-		ImageURLFile:              viper.GetString("image_url_file"),
+// newConfig builds the Config from the loaded configuration, rejecting values
+// that can't be used.
+func newConfig() (*Config, error) {
+	maxImageSize, err := parseMaxImageSize(viper.GetString("max_image_size_mb"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid max_image_size_mb: %v", err)
+	}
+
+	segmentThreshold, err := parseMaxImageSize(viper.GetString("segment_threshold"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid segment_threshold: %v", err)
+	}
+
+	inputFormat := strings.ToLower(viper.GetString("input_format"))
+	if !validInputFormat(inputFormat) {
+		return nil, fmt.Errorf("invalid input_format %q: must be auto, text, jsonl, csv, tsv, sitemap, feed or iiif", viper.GetString("input_format"))
+	}
+
+	inputURLType := strings.ToLower(viper.GetString("input_url_type"))
+	if !validInputURLType(inputURLType) {
+		return nil, fmt.Errorf("invalid input_url_type %q: must be image or html", viper.GetString("input_url_type"))
+	}
+
+	sitemapModifiedSince, err := parseModifiedSince(viper.GetString("sitemap_modified_since"), time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid sitemap_modified_since: %v", err)
+	}
+
+	if err := validMIMETypePatterns(viper.GetStringSlice("feed_mime_types")); err != nil {
+		return nil, fmt.Errorf("invalid feed_mime_types: %v", err)
+	}
+
+	err = validIIIFImageRequest(viper.GetString("iiif_size"), viper.GetString("iiif_quality"), viper.GetString("iiif_format"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid iiif_* setting: %v", err)
+	}
+
+	_, err = newURLNormalizer(viper.GetStringSlice("normalize_urls"), viper.GetStringSlice("strip_query_params"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid normalize_urls: %v", err)
+	}
+
+	var filenameTemplate *FilenameTemplate
+	if text := viper.GetString("filename_template"); text != "" {
+		filenameTemplate, err = ParseFilenameTemplate(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filename_template: %v", err)
+		}
+	}
+
+	extensionPolicy, err := parseExtensionPolicy(viper.GetString("extension_policy"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid extension_policy: %v", err)
+	}
+
+	if viper.GetInt("batch_size") < 1 {
+		return nil, fmt.Errorf("invalid batch_size: must be at least 1")
+	}
+
+	return &Config{
+		ImageURLFiles:             imageURLFiles(),
+		InputFormat:               inputFormat,
+		InputURLType:              inputURLType,
+		SitemapModifiedSince:      sitemapModifiedSince,
+		FeedMIMETypes:             viper.GetStringSlice("feed_mime_types"),
+		FeedStateFile:             viper.GetString("feed_state_file"),
+		IIIFSize:                  viper.GetString("iiif_size"),
+		IIIFQuality:               viper.GetString("iiif_quality"),
+		IIIFFormat:                viper.GetString("iiif_format"),
+		CSVHeader:                 viper.GetBool("csv_header"),
+		CSVURLColumn:              viper.GetString("csv_url_column"),
+		CSVFilenameColumns:        viper.GetStringSlice("csv_filename_columns"),
+		CSVSubdirColumns:          viper.GetStringSlice("csv_subdir_columns"),
+		PriorityWindow:            viper.GetInt("priority_window"),
+		ExpandURLBraces:           viper.GetBool("expand_url_braces"),
+		NormalizeURLs:             viper.GetStringSlice("normalize_urls"),
+		StripQueryParams:          viper.GetStringSlice("strip_query_params"),
+		DedupeURLs:                viper.GetBool("dedupe_urls"),
+		StrictInput:               viper.GetBool("strict_input"),
+		RejectedLinesFile:         viper.GetString("rejected_lines_file"),
 		DownloadDirectory:         viper.GetString("download_directory"),
+		FilenameTemplate:          filenameTemplate,
+		ExtensionPolicy:           extensionPolicy,
 		BatchSize:                 viper.GetInt("batch_size"),
+		Concurrency:               viper.GetInt("concurrency"),
 		MinWaitTime:               viper.GetFloat64("min_wait_time"),
 		MaxWaitTime:               viper.GetFloat64("max_wait_time"),
-		MaxImageSizeMB:            viper.GetString("max_image_size_mb"),
+		MaxImageSize:              maxImageSize,
+		SizePrecheck:              viper.GetBool("size_precheck"),
 		ReplaceDownloadedFileSize: viper.GetBool("replace_downloaded_file_size"),
 		SkipIfFileExists:          viper.GetBool("skip_if_file_exists"),
+		RetryMaxAttempts:          viper.GetInt("retry_max_attempts"),
+		RetryBaseDelay:            viper.GetFloat64("retry_base_delay"),
+		RetryMaxDelay:             viper.GetFloat64("retry_max_delay"),
+		RetryJitter:               viper.GetFloat64("retry_jitter"),
+		RetryStatusCodes:          viper.GetIntSlice("retry_status_codes"),
+		RetryNetworkErrors:        viper.GetStringSlice("retry_network_errors"),
+		HTTPTimeout:               viper.GetFloat64("http_timeout"),
+		SegmentThreshold:          segmentThreshold,
+		SegmentCount:              viper.GetInt("segment_count"),
+		FailFast:                  viper.GetBool("fail_fast"),
+		FailedURLFile:             viper.GetString("failed_url_file"),
+	}, nil
+}
+
+// imageURLFiles returns the image_url_file setting, a single path or pattern or
+// a list of them.
+func imageURLFiles() []string {
+	if file, ok := viper.Get("image_url_file").(string); ok {
+		// Don't let a path with spaces be split into several
+		return []string{file}
 	}
 
+	return viper.GetStringSlice("image_url_file")
+}
+
+func startImageDownloader(ctx context.Context, config *Config, downloader Downloader, urlReader URLReader,
+	imageSizeChecker ImageSizeChecker, fileChecker FileChecker, fileSizeGetter FileSizeGetter,
+	waitTimeGenerator WaitTimeGenerator, pageExtractor PageExtractor, downloadIndex *DownloadIndex,
+	feedState *FeedState) error {
+
 	helper := &Helper{
 		Downloader:        downloader,
 		URLReader:         urlReader,
@@ -111,11 +363,14 @@ func startImageDownloader(downloader Downloader, urlReader URLReader,
 		FileChecker:       fileChecker,
 		FileSizeGetter:    fileSizeGetter,
 		WaitTimeGenerator: waitTimeGenerator,
+		PageExtractor:     pageExtractor,
+		DownloadIndex:     downloadIndex,
+		FeedState:         feedState,
 	}
 
-	err := helper.DownloadImages(config)
+	err := helper.DownloadImages(ctx, config)
 	if err != nil {
-		return fmt.Errorf("failed to download images: %v", err)
+		return fmt.Errorf("failed to download images: %w", err)
 	}
 
 	return nil
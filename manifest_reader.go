@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Input formats for the input_format key.
+const (
+	InputFormatAuto  = "auto"
+	InputFormatText  = "text"
+	InputFormatJSONL = "jsonl"
+	InputFormatCSV   = "csv"
+	InputFormatTSV   = "tsv"
+	// InputFormatSitemap reads XML sitemaps and sitemap indexes.
+	InputFormatSitemap = "sitemap"
+	// InputFormatFeed reads RSS, Atom and JSON feeds.
+	InputFormatFeed = "feed"
+	// InputFormatIIIF reads IIIF Presentation manifests.
+	InputFormatIIIF = "iiif"
+)
+
+// manifestRecord is one line of a JSON Lines manifest.
+type manifestRecord struct {
+	URL      string            `json:"url"`
+	Filename string            `json:"filename"`
+	Subdir   string            `json:"subdir"`
+	SHA256   string            `json:"sha256"`
+	Headers  map[string]string `json:"headers"`
+	MaxSize  json.RawMessage   `json:"max_size"`
+	Priority int               `json:"priority"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ManifestURLReader reads image requests from a JSON Lines manifest, one JSON
+// object per line. Only url is required, blank lines and lines starting with #
+// are ignored.
+type ManifestURLReader struct{}
+
+func NewManifestURLReader() *ManifestURLReader {
+	return &ManifestURLReader{}
+}
+
+func (r *ManifestURLReader) OpenImageRequests(ctx context.Context, filePath string) (ImageRequestStream, error) {
+	file, err := openInput(ctx, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	return &manifestStream{path: inputName(filePath), file: file, reader: bufio.NewReader(file)}, nil
+}
+
+// manifestStream parses a manifest one line at a time.
+type manifestStream struct {
+	path   string
+	file   io.ReadCloser
+	reader *bufio.Reader
+	line   int
+}
+
+func (s *manifestStream) Next() (ImageRequest, error) {
+	for {
+		line, err := s.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return ImageRequest{}, fmt.Errorf("failed to read file: %w", err)
+		}
+		s.line++
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] != '#' {
+			req, parseErr := parseManifestRecord(trimmed)
+			if parseErr != nil {
+				return ImageRequest{}, &InputLineError{File: s.path, Line: s.line, Text: string(trimmed), Err: parseErr}
+			}
+			return req, nil
+		}
+
+		if err == io.EOF {
+			return ImageRequest{}, io.EOF
+		}
+	}
+}
+
+func (s *manifestStream) lastLine() int {
+	return s.line
+}
+
+func (s *manifestStream) Close() error {
+	return s.file.Close()
+}
+
+// parseManifestRecord turns one manifest line into an ImageRequest.
+func parseManifestRecord(line []byte) (ImageRequest, error) {
+	var record manifestRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return ImageRequest{}, fmt.Errorf("invalid record: %v", err)
+	}
+
+	url := strings.TrimSpace(record.URL)
+	if url == "" {
+		return ImageRequest{}, errors.New("missing url")
+	}
+	if err := validateImageURL(url); err != nil {
+		return ImageRequest{}, err
+	}
+
+	if record.SHA256 != "" {
+		if digest, err := hex.DecodeString(record.SHA256); err != nil || len(digest) != 32 {
+			return ImageRequest{}, fmt.Errorf("invalid sha256 %q: expected 64 hex digits", record.SHA256)
+		}
+	}
+
+	maxSize, err := parseManifestMaxSize(record.MaxSize)
+	if err != nil {
+		return ImageRequest{}, err
+	}
+
+	return ImageRequest{
+		URL:      url,
+		Filename: record.Filename,
+		Subdir:   record.Subdir,
+		SHA256:   record.SHA256,
+		Headers:  record.Headers,
+		MaxSize:  maxSize,
+		Priority: record.Priority,
+		Metadata: record.Metadata,
+	}, nil
+}
+
+// parseManifestMaxSize parses the max_size of a record, given as a string or a
+// number with the same meaning as max_image_size_mb. It returns 0 if the
+// record has none, and -1 for no limit.
+func parseManifestMaxSize(raw json.RawMessage) (int64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
+	}
+
+	var size string
+	if err := json.Unmarshal(raw, &size); err != nil {
+		var number json.Number
+		if err := json.Unmarshal(raw, &number); err != nil {
+			return 0, fmt.Errorf("invalid max_size %s: expected a string or a number", raw)
+		}
+		size = number.String()
+	}
+
+	maxSize, err := parseMaxImageSize(size)
+	if err != nil {
+		return 0, fmt.Errorf("invalid max_size: %v", err)
+	}
+	if maxSize == 0 {
+		// Zero turns the size check off, like it does for max_image_size_mb
+		return -1, nil
+	}
+
+	return maxSize, nil
+}
+
+// FormatURLReader reads the image URL file in the given input format. The auto
+// format picks the manifest reader for .jsonl and .ndjson files, the CSV reader
+// for .csv and .tsv files, the feed reader for .rss and .atom files and the
+// plain URL list reader for anything else. Sitemaps, feeds and IIIF manifests
+// are told apart by their contents for .xml, .xml.gz and .json files and URLs.
+type FormatURLReader struct {
+	Format string
+	// CSVColumns are the columns read from CSV and TSV files.
+	CSVColumns CSVColumns
+	// ExpandBraces expands the brace patterns in the URLs of URL lists,
+	// manifests and CSV and TSV files. The URLs of sitemaps, feeds and IIIF
+	// manifests are never expanded.
+	ExpandBraces bool
+	// HTTPClient fetches the inputs given as URLs, with RetryPolicy.
+	HTTPClient  HTTPClient
+	RetryPolicy *RetryPolicy
+	// Sitemap, Feed and IIIF read sitemaps, feeds and IIIF manifests. Readers
+	// using HTTPClient are used if nil.
+	Sitemap *SitemapURLReader
+	Feed    *FeedURLReader
+	IIIF    *IIIFURLReader
+}
+
+func NewFormatURLReader(format string) *FormatURLReader {
+	return &FormatURLReader{Format: format, HTTPClient: NewStandardHTTPClient()}
+}
+
+func (r *FormatURLReader) OpenImageRequests(ctx context.Context, filePath string) (ImageRequestStream, error) {
+	format := r.format(filePath)
+	if format == "" {
+		return r.openDocument(ctx, filePath)
+	}
+
+	reader, err := r.reader(format)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := reader.OpenImageRequests(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Documents fetched from elsewhere could ask for any number of images,
+	// only expand the patterns written into the local lists
+	if r.ExpandBraces && isListFormat(format) {
+		return newExpandingStream(stream, inputName(filePath)), nil
+	}
+	return stream, nil
+}
+
+// isListFormat reports whether the input format is a list of image requests
+// written by hand or exported from elsewhere, rather than a sitemap, feed or
+// IIIF manifest.
+func isListFormat(format string) bool {
+	switch format {
+	case InputFormatText, InputFormatJSONL, InputFormatCSV, InputFormatTSV:
+		return true
+	}
+	return false
+}
+
+// format returns the input format of the file, or "" if only its contents tell.
+func (r *FormatURLReader) format(filePath string) string {
+	if r.Format != "" && r.Format != InputFormatAuto {
+		return r.Format
+	}
+
+	// Only sitemaps and feeds are read compressed or from URLs
+	if strings.HasSuffix(strings.ToLower(filePath), ".xml.gz") || isRemoteInput(filePath) {
+		return ""
+	}
+
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".jsonl", ".ndjson":
+		return InputFormatJSONL
+	case ".csv":
+		return InputFormatCSV
+	case ".tsv":
+		return InputFormatTSV
+	case ".rss", ".atom":
+		return InputFormatFeed
+	case ".xml", ".json":
+		return ""
+	}
+	return InputFormatText
+}
+
+func (r *FormatURLReader) reader(format string) (URLReader, error) {
+	switch format {
+	case InputFormatText:
+		return NewDefaultURLReader(), nil
+	case InputFormatJSONL:
+		return NewManifestURLReader(), nil
+	case InputFormatCSV:
+		return NewCSVURLReader(',', r.CSVColumns), nil
+	case InputFormatTSV:
+		return NewCSVURLReader('\t', r.CSVColumns), nil
+	case InputFormatSitemap:
+		return r.sitemap(), nil
+	case InputFormatFeed:
+		return r.feed(), nil
+	case InputFormatIIIF:
+		return r.iiif(), nil
+	default:
+		return nil, fmt.Errorf("unknown input format %q", r.Format)
+	}
+}
+
+// openDocument opens a sitemap, a feed or a IIIF manifest, picking the reader
+// by its contents.
+func (r *FormatURLReader) openDocument(ctx context.Context, filePath string) (ImageRequestStream, error) {
+	doc, err := openDocument(ctx, r.HTTPClient, r.RetryPolicy, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input: %w", err)
+	}
+
+	switch sniffInputFormat(doc) {
+	case InputFormatSitemap:
+		return r.sitemap().readDocument(ctx, filePath, doc), nil
+	case InputFormatFeed:
+		return r.feed().readDocument(filePath, doc)
+	case InputFormatIIIF:
+		return r.iiif().readDocument(doc)
+	}
+
+	doc.Close()
+	return nil, fmt.Errorf("%s is neither a sitemap, a feed nor a IIIF manifest, set input_format to read it", inputName(filePath))
+}
+
+func (r *FormatURLReader) sitemap() *SitemapURLReader {
+	if r.Sitemap == nil {
+		r.Sitemap = NewSitemapURLReader(r.HTTPClient)
+		r.Sitemap.RetryPolicy = r.RetryPolicy
+	}
+	return r.Sitemap
+}
+
+func (r *FormatURLReader) iiif() *IIIFURLReader {
+	if r.IIIF == nil {
+		r.IIIF = NewIIIFURLReader(r.HTTPClient)
+		r.IIIF.RetryPolicy = r.RetryPolicy
+	}
+	return r.IIIF
+}
+
+func (r *FormatURLReader) feed() *FeedURLReader {
+	if r.Feed == nil {
+		r.Feed = NewFeedURLReader(r.HTTPClient)
+		r.Feed.RetryPolicy = r.RetryPolicy
+	}
+	return r.Feed
+}
+
+// validInputFormat reports whether format is one of the InputFormat* values.
+// An empty format means auto.
+func validInputFormat(format string) bool {
+	switch format {
+	case "", InputFormatAuto, InputFormatText, InputFormatJSONL, InputFormatCSV, InputFormatTSV, InputFormatSitemap, InputFormatFeed, InputFormatIIIF:
+		return true
+	}
+	return false
+}
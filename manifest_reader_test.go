@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestURLReader(t *testing.T) {
+	manifest := createTempFile(t, []byte(`{"url": "https://example.com/a.jpg"}
+
+{"url": "https://example.com/b.jpg", "filename": "b-cover.jpg", "subdir": "books", "priority": 5, "extra": true}
+{"url": "https://example.com/c.jpg", "headers": {"Referer": "https://example.com/"}, "max_size": "2MB"}
+{"url": "https://example.com/d.jpg", "max_size": 1, "sha256": "9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08"}
+{"url": "https://example.com/e.jpg", "max_size": "MAX", "metadata": {"isbn": "9780306406157"}}`))
+	defer os.Remove(manifest)
+
+	requests, err := readAllImageRequests(NewManifestURLReader(), manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{
+		{URL: "https://example.com/a.jpg"},
+		{URL: "https://example.com/b.jpg", Filename: "b-cover.jpg", Subdir: "books", Priority: 5},
+		{URL: "https://example.com/c.jpg", Headers: map[string]string{"Referer": "https://example.com/"}, MaxSize: 2 << 20},
+		{URL: "https://example.com/d.jpg", MaxSize: 1 << 20, SHA256: "9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08"},
+		{URL: "https://example.com/e.jpg", MaxSize: -1, Metadata: map[string]string{"isbn": "9780306406157"}},
+	}, requests)
+}
+
+func TestManifestURLReader_InvalidRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		err      string
+	}{
+		{"not json", "https://example.com/a.jpg", ":1: invalid record"},
+		{"missing url", `{"url": "https://example.com/a.jpg"}` + "\n" + `{"filename": "a.jpg"}`, ":2: missing url"},
+		{"relative url", `{"url": "images/a.jpg"}`, ":1: invalid URL"},
+		{"bad sha256", `{"url": "https://example.com/a.jpg", "sha256": "abc"}`, "invalid sha256"},
+		{"bad max_size", `{"url": "https://example.com/a.jpg", "max_size": "lots"}`, "invalid max_size"},
+		{"max_size type", `{"url": "https://example.com/a.jpg", "max_size": true}`, "invalid max_size"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := createTempFile(t, []byte(tt.manifest))
+			defer os.Remove(manifest)
+
+			_, err := readAllImageRequests(NewManifestURLReader(), manifest)
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestFormatURLReader(t *testing.T) {
+	dir := t.TempDir()
+	textFile := filepath.Join(dir, "urls.txt")
+	manifestFile := filepath.Join(dir, "urls.jsonl")
+	assert.NoError(t, os.WriteFile(textFile, []byte("https://example.com/a.jpg\n"), 0644))
+	assert.NoError(t, os.WriteFile(manifestFile, []byte(`{"url": "https://example.com/b.jpg", "priority": 1}`+"\n"), 0644))
+
+	requests, err := readAllImageRequests(NewFormatURLReader(InputFormatAuto), textFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{{URL: "https://example.com/a.jpg"}}, requests)
+
+	requests, err = readAllImageRequests(NewFormatURLReader(InputFormatAuto), manifestFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{{URL: "https://example.com/b.jpg", Priority: 1}}, requests)
+
+	sitemapFile := filepath.Join(dir, "sitemap.xml")
+	assert.NoError(t, os.WriteFile(sitemapFile, []byte(imageSitemap(
+		`<url><loc>https://example.com/</loc><image:image><image:loc>https://example.com/c.jpg</image:loc></image:image></url>`)), 0644))
+	requests, err = readAllImageRequests(NewFormatURLReader(InputFormatAuto), sitemapFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{{URL: "https://example.com/c.jpg"}}, requests)
+
+	// .xml files are told apart by their contents
+	feedFile := filepath.Join(dir, "photos.xml")
+	assert.NoError(t, os.WriteFile(feedFile, []byte(rssFeed), 0644))
+	requests, err = readAllImageRequests(NewFormatURLReader(InputFormatAuto), feedFile)
+	assert.NoError(t, err)
+	assert.Len(t, requests, 4)
+
+	// An explicit format wins over the extension
+	_, err = readAllImageRequests(NewFormatURLReader(InputFormatJSONL), textFile)
+	assert.ErrorContains(t, err, "invalid record")
+
+	_, err = readAllImageRequests(NewFormatURLReader("xml"), textFile)
+	assert.ErrorContains(t, err, "unknown input format")
+}
+
+func TestManifestURLReader_LongLines(t *testing.T) {
+	longURL := "https://example.com/image.jpg?q=" + strings.Repeat("a", 100*1024)
+	manifest := createTempFile(t, []byte(`{"url": "`+longURL+`"}`+"\n"+`{"url": "https://example.com/b.jpg"}`))
+	defer os.Remove(manifest)
+
+	requests, err := readAllImageRequests(NewManifestURLReader(), manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{longURL, "https://example.com/b.jpg"}, requestURLs(requests))
+}
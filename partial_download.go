@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	partFileSuffix = ".part"
+	metaFileSuffix = ".part.json"
+)
+
+// partialDownload is an interrupted download kept next to its target file as
+// a .part file, together with the validators of the response it came from so
+// the rest can be requested with Range and If-Range.
+type partialDownload struct {
+	path string
+	size int64
+
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	AcceptRanges bool   `json:"accept_ranges"`
+}
+
+// loadPartialDownload returns the partial download of url into filePath. If
+// there is none, or it was left behind by another URL, the result is empty.
+func loadPartialDownload(filePath, url string) *partialDownload {
+	part := &partialDownload{path: filePath + partFileSuffix, URL: url}
+
+	data, err := os.ReadFile(filePath + metaFileSuffix)
+	if err != nil {
+		return part
+	}
+
+	var saved partialDownload
+	if json.Unmarshal(data, &saved) != nil || saved.URL != url {
+		return part
+	}
+
+	info, err := os.Stat(part.path)
+	if err != nil {
+		return part
+	}
+
+	saved.path = part.path
+	saved.size = info.Size()
+	return &saved
+}
+
+// newPartialDownload starts a partial download of url into filePath from the
+// headers of a full response.
+func newPartialDownload(filePath, url string, header http.Header) *partialDownload {
+	return &partialDownload{
+		path:         filePath + partFileSuffix,
+		URL:          url,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+		AcceptRanges: header.Get("Accept-Ranges") == "bytes",
+	}
+}
+
+// validator returns the value for an If-Range header: the ETag if it is a
+// strong one, otherwise the Last-Modified date.
+func (p *partialDownload) validator() string {
+	if p.ETag != "" && !strings.HasPrefix(p.ETag, "W/") {
+		return p.ETag
+	}
+	return p.LastModified
+}
+
+// resumable reports whether the server allows the rest of the download to be
+// requested safely.
+func (p *partialDownload) resumable() bool {
+	return p.AcceptRanges && p.validator() != ""
+}
+
+func (p *partialDownload) metaPath() string {
+	return strings.TrimSuffix(p.path, partFileSuffix) + metaFileSuffix
+}
+
+func (p *partialDownload) save() error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p.metaPath(), data, 0644)
+}
+
+func (p *partialDownload) remove() {
+	os.Remove(p.path)
+	os.Remove(p.metaPath())
+	p.size = 0
+}
+
+// parseContentRange parses a "bytes first-last/total" Content-Range header.
+// The total is -1 if the server didn't know it.
+func parseContentRange(header string) (first, last, total int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	byteRange, totalStr, ok := strings.Cut(spec, "/")
+	firstStr, lastStr, ok2 := strings.Cut(byteRange, "-")
+	if !ok || !ok2 {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	first, err1 := strconv.ParseInt(firstStr, 10, 64)
+	last, err2 := strconv.ParseInt(lastStr, 10, 64)
+	if err1 != nil || err2 != nil || last < first {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	total = -1
+	if totalStr != "*" {
+		if total, err = strconv.ParseInt(totalStr, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+	}
+
+	return first, last, total, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseContentRange(t *testing.T) {
+	first, last, total, err := parseContentRange("bytes 500-999/1000")
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{500, 999, 1000}, []int64{first, last, total})
+
+	_, _, total, err = parseContentRange("bytes 0-99/*")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), total)
+
+	for _, header := range []string{"", "bytes */1000", "items 0-1/2", "bytes 9-1/10", "bytes a-b/c"} {
+		_, _, _, err := parseContentRange(header)
+		assert.Error(t, err, header)
+	}
+}
+
+func TestPartialDownload_Validator(t *testing.T) {
+	header := http.Header{}
+	header.Set("ETag", `W/"weak"`)
+	header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	header.Set("Accept-Ranges", "bytes")
+
+	part := newPartialDownload("image.jpg", "https://example.com/image.jpg", header)
+	assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", part.validator())
+	assert.True(t, part.resumable())
+
+	part.ETag = `"strong"`
+	assert.Equal(t, `"strong"`, part.validator())
+
+	part.AcceptRanges = false
+	assert.False(t, part.resumable())
+}
+
+func TestLoadPartialDownload(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "image.jpg")
+	header := http.Header{}
+	header.Set("ETag", `"v1"`)
+	header.Set("Accept-Ranges", "bytes")
+
+	part := newPartialDownload(filePath, "https://example.com/image.jpg", header)
+	assert.NoError(t, part.save())
+	assert.NoError(t, os.WriteFile(filePath+partFileSuffix, []byte("12345"), 0644))
+
+	loaded := loadPartialDownload(filePath, "https://example.com/image.jpg")
+	assert.Equal(t, int64(5), loaded.size)
+	assert.Equal(t, `"v1"`, loaded.validator())
+
+	// A part file left behind by another URL isn't resumed
+	other := loadPartialDownload(filePath, "https://example.com/other/image.jpg")
+	assert.Zero(t, other.size)
+	assert.False(t, other.resumable())
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Error classes written to the failed URL report, besides the NetErr* classes.
+const (
+	ErrClassHTTPStatus = "http_status"
+	ErrClassCanceled   = "canceled"
+	ErrClassFile       = "file"
+	ErrClassChecksum   = "checksum"
+	ErrClassOther      = "other"
+)
+
+// FailureReport writes failed downloads to a tab-separated file with one
+// "URL, error class, HTTP status, error message" line per URL. The URL comes
+// first so the report can be used as the image_url_file of a retry run.
+type FailureReport struct {
+	out *reportFile
+}
+
+// NewFailureReport starts the report for filePath. It replaces the file when
+// it is closed, so a retry run can read the previous report while writing the
+// new one.
+func NewFailureReport(filePath string) (*FailureReport, error) {
+	out, err := createReportFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FailureReport{out: out}, nil
+}
+
+// Write appends every failed result to the report.
+func (r *FailureReport) Write(results []DownloadResult) error {
+	for _, result := range results {
+		if result.Err == nil {
+			continue
+		}
+
+		var status int
+		var statusErr *HTTPStatusError
+		if errors.As(result.Err, &statusErr) {
+			status = statusErr.StatusCode
+		}
+
+		message := strings.Join(strings.Fields(result.Err.Error()), " ")
+		_, err := fmt.Fprintf(r.out.writer, "%s\t%s\t%d\t%s\n", result.URL, errorClass(result.Err), status, message)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.out.writer.Flush()
+}
+
+// Close moves the report into place. It is safe to call more than once.
+func (r *FailureReport) Close() error {
+	return r.out.close()
+}
+
+// errorClass sorts a download error into a coarse class for the failed URL report.
+func errorClass(err error) string {
+	var statusErr *HTTPStatusError
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &statusErr):
+		return ErrClassHTTPStatus
+	case errors.Is(err, context.Canceled):
+		return ErrClassCanceled
+	case errors.Is(err, ErrChecksumMismatch):
+		return ErrClassChecksum
+	case networkErrorClass(err) != "":
+		return networkErrorClass(err)
+	case errors.As(err, &pathErr), errors.As(err, new(*os.LinkError)):
+		return ErrClassFile
+	}
+
+	return ErrClassOther
+}
+
+// RejectedLineReport writes the skipped lines of the input files to a
+// tab-separated file with one "file, line number, reason, line" row each.
+type RejectedLineReport struct {
+	out *reportFile
+
+	// Count is the number of lines written.
+	Count int
+}
+
+// NewRejectedLineReport starts the report for filePath, which is replaced when
+// the report is closed. With an empty path the rejected lines are only counted.
+func NewRejectedLineReport(filePath string) (*RejectedLineReport, error) {
+	if filePath == "" {
+		return &RejectedLineReport{}, nil
+	}
+
+	out, err := createReportFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RejectedLineReport{out: out}, nil
+}
+
+// Write appends the rejected line to the report.
+func (r *RejectedLineReport) Write(lineErr *InputLineError) error {
+	r.Count++
+	if r.out == nil {
+		return nil
+	}
+
+	reason := strings.Join(strings.Fields(lineErr.Err.Error()), " ")
+	text := strings.Join(strings.Fields(lineErr.Text), " ")
+	_, err := fmt.Fprintf(r.out.writer, "%s\t%d\t%s\t%s\n", lineErr.File, lineErr.Line, reason, text)
+	if err != nil {
+		return err
+	}
+
+	return r.out.writer.Flush()
+}
+
+// Close moves the report into place. It is safe to call more than once.
+func (r *RejectedLineReport) Close() error {
+	if r.out == nil {
+		return nil
+	}
+	return r.out.close()
+}
+
+// reportFile is a report written to a temporary file next to its path and
+// renamed into place when closed. Until then the previous report stays
+// readable, even if it is one of the input files of the run.
+type reportFile struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func createReportFile(path string) (*reportFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return &reportFile{path: path, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (f *reportFile) close() error {
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.writer.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.file.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.file.Name())
+	}
+	f.file = nil
+
+	return err
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureReport_Write(t *testing.T) {
+	reportFile := filepath.Join(t.TempDir(), "failed_urls.txt")
+	report, err := NewFailureReport(reportFile)
+	assert.NoError(t, err)
+
+	err = report.Write([]DownloadResult{
+		{URL: "https://example.com/image1.jpg"},
+		{URL: "https://example.com/image2.jpg", Err: fmt.Errorf("failed to download image, %w",
+			&HTTPStatusError{StatusCode: http.StatusNotFound, Status: "404 Not Found"})},
+		{URL: "https://example.com/image3.jpg", Skipped: true},
+		{URL: "https://example.com/image4.jpg", Err: fmt.Errorf("failed to save image:\n%w", io.ErrUnexpectedEOF)},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, report.Close())
+	assert.NoError(t, report.Close())
+
+	contents, err := os.ReadFile(reportFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/image2.jpg\thttp_status\t404\tfailed to download image, status: 404 Not Found\n"+
+		"https://example.com/image4.jpg\tunexpected_eof\t0\tfailed to save image: unexpected EOF\n", string(contents))
+
+	// The report can be read back as a list of URLs to retry
+	requests, err := readAllImageRequests(NewDefaultURLReader(), reportFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/image2.jpg", "https://example.com/image4.jpg"}, requestURLs(requests))
+}
+
+func TestErrorClass(t *testing.T) {
+	_, statErr := os.Stat(filepath.Join(t.TempDir(), "missing"))
+
+	assert.Equal(t, ErrClassHTTPStatus, errorClass(&HTTPStatusError{StatusCode: 503}))
+	assert.Equal(t, ErrClassCanceled, errorClass(fmt.Errorf("download: %w", context.Canceled)))
+	assert.Equal(t, NetErrUnexpectedEOF, errorClass(io.ErrUnexpectedEOF))
+	assert.Equal(t, ErrClassFile, errorClass(statErr))
+	assert.Equal(t, ErrClassOther, errorClass(errors.New("boom")))
+}
+
+func TestDownloadImages_ContinueOnError(t *testing.T) {
+	downloader := &blockingDownloader{
+		release: make(chan struct{}),
+		fail:    map[string]bool{"https://example.com/image2.jpg": true},
+	}
+	close(downloader.release)
+	helper := &Helper{
+		Downloader:        downloader,
+		URLReader:         NewDefaultURLReader(),
+		ImageSizeChecker:  &stubImageSizeChecker{},
+		FileChecker:       NewDefaultFileChecker(),
+		WaitTimeGenerator: NewDefaultWaitTimeGenerator(),
+	}
+
+	tempDir := t.TempDir()
+	urlFile := createTempFile(t, []byte("https://example.com/image1.jpg\nhttps://example.com/image2.jpg\nhttps://example.com/image3.jpg"))
+	config := &Config{
+		ImageURLFiles:     []string{urlFile},
+		DownloadDirectory: tempDir,
+		BatchSize:         1,
+		MaxImageSize:      -1,
+		FailFast:          false,
+		FailedURLFile:     filepath.Join(tempDir, "failed_urls.txt"),
+	}
+
+	err := helper.DownloadImages(context.Background(), config)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), downloader.calls)
+
+	requests, err := readAllImageRequests(NewDefaultURLReader(), config.FailedURLFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/image2.jpg"}, requestURLs(requests))
+}
+
+func TestDownloadSummary_Add(t *testing.T) {
+	var summary DownloadSummary
+	summary.Add([]DownloadResult{
+		{URL: "https://example.com/image1.jpg"},
+		{URL: "https://example.com/image2.jpg", Skipped: true},
+		{URL: "https://example.com/image3.jpg", Err: errors.New("boom")},
+		{URL: "https://example.com/image4.jpg"},
+	})
+
+	assert.Equal(t, DownloadSummary{Succeeded: 2, Skipped: 1, Failed: 1}, summary)
+}
+
+func TestRejectedLineReport_Write(t *testing.T) {
+	reportFile := filepath.Join(t.TempDir(), "rejected_lines.txt")
+	report, err := NewRejectedLineReport(reportFile)
+	assert.NoError(t, err)
+
+	assert.NoError(t, report.Write(&InputLineError{File: "urls.txt", Line: 3, Text: "not a url", Err: errors.New("invalid URL")}))
+	assert.NoError(t, report.Write(&InputLineError{File: "urls.csv", Line: 7, Err: errors.New("wrong number\nof fields")}))
+	assert.NoError(t, report.Close())
+	assert.NoError(t, report.Close())
+	assert.Equal(t, 2, report.Count)
+
+	contents, err := os.ReadFile(reportFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "urls.txt\t3\tinvalid URL\tnot a url\n"+
+		"urls.csv\t7\twrong number of fields\t\n", string(contents))
+}
+
+func TestDownloadImages_InvalidInputLines(t *testing.T) {
+	urlFile := createTempFile(t, []byte("https://example.com/image1.jpg\nnot a url\nhttps://example.com/image2.jpg\n"))
+	defer os.Remove(urlFile)
+
+	for _, strict := range []bool{false, true} {
+		downloader := &recordingDownloader{}
+		helper := &Helper{
+			Downloader:        downloader,
+			URLReader:         NewDefaultURLReader(),
+			ImageSizeChecker:  &stubImageSizeChecker{},
+			FileChecker:       NewDefaultFileChecker(),
+			WaitTimeGenerator: NewDefaultWaitTimeGenerator(),
+		}
+		config := &Config{
+			ImageURLFiles:     []string{urlFile},
+			DownloadDirectory: t.TempDir(),
+			BatchSize:         1,
+			MaxImageSize:      -1,
+			FailFast:          true,
+			StrictInput:       strict,
+			RejectedLinesFile: filepath.Join(t.TempDir(), "rejected_lines.txt"),
+		}
+
+		err := helper.DownloadImages(context.Background(), config)
+		if strict {
+			assert.ErrorContains(t, err, urlFile+":2: invalid URL")
+			assert.Equal(t, []string{"https://example.com/image1.jpg"}, downloader.urls)
+			assert.NoFileExists(t, config.RejectedLinesFile)
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"https://example.com/image1.jpg", "https://example.com/image2.jpg"}, downloader.urls)
+		contents, err := os.ReadFile(config.RejectedLinesFile)
+		assert.NoError(t, err)
+		assert.Contains(t, string(contents), urlFile+"\t2\tinvalid URL")
+	}
+}
+
+func TestDownloadImages_RetryFromFailureReport(t *testing.T) {
+	downloader := &blockingDownloader{
+		release: make(chan struct{}),
+		fail:    map[string]bool{"https://example.com/image2.jpg": true},
+	}
+	close(downloader.release)
+	helper := &Helper{
+		Downloader:        downloader,
+		URLReader:         NewDefaultURLReader(),
+		ImageSizeChecker:  &stubImageSizeChecker{},
+		FileChecker:       NewDefaultFileChecker(),
+		WaitTimeGenerator: NewDefaultWaitTimeGenerator(),
+	}
+
+	// The failed URLs of the previous run are both the input and the report
+	tempDir := t.TempDir()
+	reportFile := filepath.Join(tempDir, "failed_urls.txt")
+	err := os.WriteFile(reportFile, []byte("https://example.com/image1.jpg\tother\t0\tboom\n"+
+		"https://example.com/image2.jpg\tother\t0\tboom\n"), 0644)
+	assert.NoError(t, err)
+	config := &Config{
+		ImageURLFiles:     []string{reportFile},
+		DownloadDirectory: tempDir,
+		BatchSize:         1,
+		MaxImageSize:      -1,
+		FailFast:          false,
+		FailedURLFile:     reportFile,
+	}
+
+	err = helper.DownloadImages(context.Background(), config)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), downloader.calls)
+
+	contents, err := os.ReadFile(reportFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/image2.jpg\tother\t0\tfailed to download image: download failed\n", string(contents))
+
+	// No temporary report is left behind
+	matches, err := filepath.Glob(reportFile + ".*.tmp")
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Network error classes that a RetryPolicy can be configured to retry.
+const (
+	NetErrTimeout           = "timeout"
+	NetErrConnectionReset   = "connection_reset"
+	NetErrConnectionRefused = "connection_refused"
+	NetErrUnexpectedEOF     = "unexpected_eof"
+	NetErrDNS               = "dns"
+)
+
+// HTTPStatusError reports a response whose status code was not the expected one.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("status: %s", e.Status)
+}
+
+// RetryPolicy decides whether and when a failed operation is attempted again.
+// A nil *RetryPolicy runs the operation exactly once.
+type RetryPolicy struct {
+	MaxAttempts          int
+	BaseDelay            time.Duration
+	MaxDelay             time.Duration
+	Jitter               float64
+	RetryableStatusCodes []int
+	RetryableNetErrors   []string
+}
+
+func newRetryPolicy(config *Config) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:          config.RetryMaxAttempts,
+		BaseDelay:            time.Duration(config.RetryBaseDelay * float64(time.Second)),
+		MaxDelay:             time.Duration(config.RetryMaxDelay * float64(time.Second)),
+		Jitter:               config.RetryJitter,
+		RetryableStatusCodes: config.RetryStatusCodes,
+		RetryableNetErrors:   config.RetryNetworkErrors,
+	}
+}
+
+// Do runs op until it succeeds, fails with an error that isn't retryable, the
+// attempts run out or ctx is cancelled. Every failed attempt is logged.
+func (p *RetryPolicy) Do(ctx context.Context, description string, op func() error) error {
+	maxAttempts := 1
+	if p != nil && p.MaxAttempts > 1 {
+		maxAttempts = p.MaxAttempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= maxAttempts || !p.IsRetryable(err) || ctx.Err() != nil {
+			if maxAttempts > 1 {
+				log.Printf("Attempt %d/%d to %s failed: %v", attempt, maxAttempts, description, err)
+			}
+			return err
+		}
+
+		delay := p.Delay(attempt)
+		log.Printf("Attempt %d/%d to %s failed: %v; retrying in %s", attempt, maxAttempts, description, err, delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// Delay returns how long to wait after the given failed attempt: the base
+// delay doubled for every previous attempt, capped at the max delay, with up
+// to Jitter of it randomized.
+func (p *RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			delay = p.MaxDelay
+			break
+		}
+	}
+
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		delay -= time.Duration(rand.Float64() * jitter * float64(delay))
+	}
+
+	return delay
+}
+
+// IsRetryable reports whether err is a transient failure worth another attempt.
+func (p *RetryPolicy) IsRetryable(err error) bool {
+	if p == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		for _, code := range p.RetryableStatusCodes {
+			if code == statusErr.StatusCode {
+				return true
+			}
+		}
+		return false
+	}
+
+	class := networkErrorClass(err)
+	if class == "" {
+		return false
+	}
+	for _, retryable := range p.RetryableNetErrors {
+		if retryable == class {
+			return true
+		}
+	}
+
+	return false
+}
+
+// networkErrorClass maps err to one of the NetErr* classes, or returns an empty
+// string if it isn't a recognized network error.
+func networkErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return NetErrDNS
+	case isTimeout(err):
+		return NetErrTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return NetErrConnectionReset
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return NetErrConnectionRefused
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return NetErrUnexpectedEOF
+	}
+
+	return ""
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:          3,
+		BaseDelay:            time.Millisecond,
+		MaxDelay:             5 * time.Millisecond,
+		RetryableStatusCodes: []int{http.StatusServiceUnavailable},
+		RetryableNetErrors:   []string{NetErrTimeout, NetErrConnectionReset},
+	}
+}
+
+func TestRetryPolicy_RetriesUntilSuccess(t *testing.T) {
+	attempts := 0
+	err := newTestRetryPolicy().Do(context.Background(), "test", func() error {
+		attempts++
+		if attempts < 3 {
+			return &HTTPStatusError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryPolicy_StopsAfterMaxAttempts(t *testing.T) {
+	attempts := 0
+	err := newTestRetryPolicy().Do(context.Background(), "test", func() error {
+		attempts++
+		return fmt.Errorf("read failed: %w", syscall.ECONNRESET)
+	})
+
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRetryPolicy_NonRetryableError(t *testing.T) {
+	attempts := 0
+	err := newTestRetryPolicy().Do(context.Background(), "test", func() error {
+		attempts++
+		return &HTTPStatusError{StatusCode: http.StatusNotFound, Status: "404 Not Found"}
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicy_NilRunsOnce(t *testing.T) {
+	var policy *RetryPolicy
+	attempts := 0
+	err := policy.Do(context.Background(), "test", func() error {
+		attempts++
+		return io.ErrUnexpectedEOF
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := &RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	assert.Equal(t, time.Second, policy.Delay(1))
+	assert.Equal(t, 2*time.Second, policy.Delay(2))
+	assert.Equal(t, 4*time.Second, policy.Delay(3))
+	assert.Equal(t, 5*time.Second, policy.Delay(4))
+	assert.Equal(t, 5*time.Second, policy.Delay(60))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(2)
+		assert.GreaterOrEqual(t, delay, time.Second)
+		assert.LessOrEqual(t, delay, 2*time.Second)
+	}
+}
+
+func TestNetworkErrorClass(t *testing.T) {
+	assert.Equal(t, NetErrConnectionReset, networkErrorClass(fmt.Errorf("read: %w", syscall.ECONNRESET)))
+	assert.Equal(t, NetErrConnectionRefused, networkErrorClass(fmt.Errorf("dial: %w", syscall.ECONNREFUSED)))
+	assert.Equal(t, NetErrUnexpectedEOF, networkErrorClass(io.ErrUnexpectedEOF))
+	assert.Equal(t, "", networkErrorClass(errors.New("something else")))
+}
+
+func TestDownloadImage_RetriesServiceUnavailable(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("image data"))
+	}))
+	defer server.Close()
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	downloader.RetryPolicy = newTestRetryPolicy()
+
+	err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.FileExists(t, filepath.Join(downloadDir, "image.jpg"))
+}
+
+func TestGetImageFileSize_Retries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Length", "42")
+	}))
+	defer server.Close()
+
+	getter := NewDefaultFileSizeGetter(NewStandardHTTPClient())
+	getter.RetryPolicy = newTestRetryPolicy()
+
+	size, err := getter.GetImageFileSize(context.Background(), server.URL+"/image.jpg")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), size)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// byteRange is an inclusive range of bytes of a remote file.
+type byteRange struct {
+	first int64
+	last  int64
+}
+
+// splitRanges splits size bytes into count ranges of nearly equal length.
+func splitRanges(size int64, count int) []byteRange {
+	if int64(count) > size {
+		count = int(size)
+	}
+
+	ranges := make([]byteRange, 0, count)
+	var first int64
+	for i := 0; i < count; i++ {
+		last := size*int64(i+1)/int64(count) - 1
+		ranges = append(ranges, byteRange{first: first, last: last})
+		first = last + 1
+	}
+
+	return ranges
+}
+
+// shouldSegment reports whether info describes an image large enough to be
+// worth downloading in several ranges at once, from a server that allows it.
+func (d *ImageDownloader) shouldSegment(info *RemoteFileInfo) bool {
+	return d.SegmentThreshold > 0 && d.SegmentCount > 1 &&
+		info.AcceptRanges && info.Size >= d.SegmentThreshold
+}
+
+// fetchSegmented downloads the image described by info in SegmentCount byte
+// ranges over parallel connections, writing each range straight into its place
+// in a .part file that is renamed to filePath once every range has arrived.
+func (d *ImageDownloader) fetchSegmented(ctx context.Context, req ImageRequest, filePath string, info *RemoteFileInfo) (err error) {
+	url := req.URL
+
+	// Segments aren't resumed, so drop whatever an earlier attempt left behind
+	part := loadPartialDownload(filePath, url)
+	part.remove()
+
+	file, err := os.Create(part.path)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(part.path)
+		}
+	}()
+
+	if err = file.Truncate(info.Size); err != nil {
+		return fmt.Errorf("failed to allocate file: %v", err)
+	}
+
+	ranges := splitRanges(info.Size, d.SegmentCount)
+	log.Printf("Downloading %s in %d segments", url, len(ranges))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r byteRange) {
+			defer wg.Done()
+			description := fmt.Sprintf("download segment %d/%d of %s", i+1, len(ranges), url)
+			errs[i] = d.RetryPolicy.Do(ctx, description, func() error {
+				return d.fetchSegment(ctx, req, info, r, file)
+			})
+			if errs[i] != nil {
+				// No point in finishing the other segments
+				cancel()
+			}
+		}(i, r)
+	}
+	wg.Wait()
+
+	for _, segmentErr := range errs {
+		if segmentErr != nil {
+			return segmentErr
+		}
+	}
+
+	return commitPartFile(file, filePath, req)
+}
+
+// fetchSegment downloads the byte range r of the image into the same range of file.
+func (d *ImageDownloader) fetchSegment(ctx context.Context, imageReq ImageRequest, info *RemoteFileInfo, r byteRange, file *os.File) error {
+	req, err := newImageRequest(ctx, imageReq)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.first, r.last))
+
+	// Make sure every segment comes from the same version of the image
+	validator := (&partialDownload{ETag: info.ETag, LastModified: info.LastModified}).validator()
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := d.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("failed to download image segment, %w", &HTTPStatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	first, last, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return fmt.Errorf("failed to download image segment: %v", err)
+	}
+	if first != r.first || last != r.last || (total >= 0 && total != info.Size) {
+		return fmt.Errorf("failed to download image segment: got bytes %d-%d/%d, expected %d-%d/%d",
+			first, last, total, r.first, r.last, info.Size)
+	}
+
+	length := r.last - r.first + 1
+	written, err := io.Copy(io.NewOffsetWriter(file, r.first), io.LimitReader(resp.Body, length))
+	if err != nil {
+		return fmt.Errorf("failed to save image segment: %w", err)
+	}
+	if written != length {
+		return fmt.Errorf("failed to save image segment: got %d of %d bytes: %w", written, length, io.ErrUnexpectedEOF)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitRanges(t *testing.T) {
+	assert.Equal(t, []byteRange{{0, 332}, {333, 665}, {666, 999}}, splitRanges(1000, 3))
+	assert.Equal(t, []byteRange{{0, 0}, {1, 1}}, splitRanges(2, 4))
+	assert.Equal(t, []byteRange{{0, 9}}, splitRanges(10, 1))
+}
+
+func TestDownloadImage_Segmented(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789abcdef", 1000))
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "image.tif", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	downloader.FileInfoGetter = NewDefaultFileSizeGetter(NewStandardHTTPClient())
+	downloader.SegmentThreshold = 1024
+	downloader.SegmentCount = 4
+
+	err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.tif"}, downloadDir)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"bytes=0-3999", "bytes=4000-7999", "bytes=8000-11999", "bytes=12000-15999"}, ranges)
+	assertFileContent(t, filepath.Join(downloadDir, "image.tif"), content)
+}
+
+func TestDownloadImage_SegmentedBelowThreshold(t *testing.T) {
+	content := []byte("small image")
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			ranges = append(ranges, r.Header.Get("Range"))
+		}
+		http.ServeContent(w, r, "image.jpg", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	downloader.FileInfoGetter = NewDefaultFileSizeGetter(NewStandardHTTPClient())
+	downloader.SegmentThreshold = 1024
+	downloader.SegmentCount = 4
+
+	err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, ranges)
+	assertFileContent(t, filepath.Join(downloadDir, "image.jpg"), content)
+}
+
+func TestDownloadImage_SegmentedRangeIgnored(t *testing.T) {
+	content := []byte(strings.Repeat("x", 4096))
+
+	// Advertise range support but always answer with the full image
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "4096")
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+	}))
+	defer server.Close()
+
+	downloadDir := t.TempDir()
+	downloader := NewImageDownloader(NewStandardHTTPClient(), NewDefaultFileChecker())
+	downloader.FileInfoGetter = NewDefaultFileSizeGetter(NewStandardHTTPClient())
+	downloader.SegmentThreshold = 1024
+	downloader.SegmentCount = 2
+
+	err := downloader.DownloadImage(context.Background(), ImageRequest{URL: server.URL + "/image.jpg"}, downloadDir)
+	assert.Error(t, err)
+	assertDirEmpty(t, downloadDir)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// maxSitemapDepth is how deep sitemap indexes are followed.
+const maxSitemapDepth = 5
+
+// SitemapURLReader reads the image URLs of an XML sitemap: the <image:loc> of
+// the image sitemap extension of each <url> entry. A sitemap index is read by
+// reading the sitemaps it lists, which may be gzip-compressed, and sitemaps can
+// be local files or http and https URLs.
+type SitemapURLReader struct {
+	HTTPClient  HTTPClient
+	RetryPolicy *RetryPolicy
+	// ModifiedSince skips the entries whose lastmod is before it, unless it is
+	// zero. Entries without a lastmod are always read.
+	ModifiedSince time.Time
+}
+
+func NewSitemapURLReader(httpClient HTTPClient) *SitemapURLReader {
+	return &SitemapURLReader{HTTPClient: httpClient}
+}
+
+func (r *SitemapURLReader) OpenImageRequests(ctx context.Context, filePath string) (ImageRequestStream, error) {
+	doc, err := openDocument(ctx, r.HTTPClient, r.RetryPolicy, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sitemap: %w", err)
+	}
+
+	return r.readDocument(ctx, filePath, doc), nil
+}
+
+// sitemapLocation is a sitemap to read, with the sitemap index entry that
+// listed it, if any.
+type sitemapLocation struct {
+	loc    string
+	depth  int
+	parent string
+	line   int
+}
+
+// lineError attributes err to the index entry that listed the sitemap.
+func (l sitemapLocation) lineError(err error) error {
+	if l.parent == "" {
+		return err
+	}
+	return &InputLineError{File: l.parent, Line: l.line, Text: l.loc, Err: err}
+}
+
+// sitemapDocument is a sitemap being decoded.
+type sitemapDocument struct {
+	sitemapLocation
+	doc     *document
+	decoder *xml.Decoder
+}
+
+func (r *SitemapURLReader) open(ctx context.Context, location sitemapLocation) (*sitemapDocument, error) {
+	doc, err := openDocument(ctx, r.HTTPClient, r.RetryPolicy, location.loc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sitemap: %w", err)
+	}
+
+	return r.newDocument(location, doc), nil
+}
+
+func (r *SitemapURLReader) newDocument(location sitemapLocation, doc *document) *sitemapDocument {
+	return &sitemapDocument{sitemapLocation: location, doc: doc, decoder: xml.NewDecoder(doc)}
+}
+
+// readDocument reads an opened sitemap. The sitemaps of an index are fetched
+// under ctx.
+func (r *SitemapURLReader) readDocument(ctx context.Context, location string, doc *document) ImageRequestStream {
+	return &sitemapStream{
+		ctx:     ctx,
+		reader:  r,
+		current: r.newDocument(sitemapLocation{loc: location}, doc),
+		visited: map[string]bool{location: true},
+	}
+}
+
+// sitemapEntry is a <url> entry of a sitemap or a <sitemap> entry of a
+// sitemap index.
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+	Images  []struct {
+		Loc string `xml:"loc"`
+	} `xml:"image"`
+}
+
+// sitemapStream yields the images of a sitemap, reading the sitemaps of an
+// index one after the other as the stream is read.
+type sitemapStream struct {
+	ctx     context.Context
+	reader  *SitemapURLReader
+	current *sitemapDocument
+	pending []sitemapLocation
+	visited map[string]bool
+	results []requestResult
+}
+
+func (s *sitemapStream) Next() (ImageRequest, error) {
+	for len(s.results) == 0 {
+		if s.current == nil {
+			if len(s.pending) == 0 {
+				return ImageRequest{}, io.EOF
+			}
+
+			location := s.pending[0]
+			s.pending = s.pending[1:]
+			log.Printf("Reading sitemap %s", location.loc)
+			doc, err := s.reader.open(s.ctx, location)
+			if err != nil {
+				return ImageRequest{}, location.lineError(err)
+			}
+			s.current = doc
+			continue
+		}
+
+		err := s.readEntry()
+		if err == nil {
+			continue
+		}
+
+		location := s.current.sitemapLocation
+		s.current.doc.Close()
+		s.current = nil
+		if err != io.EOF {
+			return ImageRequest{}, location.lineError(err)
+		}
+	}
+
+	result := s.results[0]
+	s.results = s.results[1:]
+	return result.req, result.err
+}
+
+// readEntry reads the next entry of the current sitemap into the results, or
+// the pending sitemaps for an index entry. It returns io.EOF after the last.
+func (s *sitemapStream) readEntry() error {
+	doc := s.current
+	for {
+		token, err := doc.decoder.Token()
+		if err == io.EOF {
+			return io.EOF
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse sitemap %s: %w", doc.doc.name, err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || (start.Name.Local != "url" && start.Name.Local != "sitemap") {
+			continue
+		}
+
+		line, _ := doc.decoder.InputPos()
+		var entry sitemapEntry
+		if err := doc.decoder.DecodeElement(&entry, &start); err != nil {
+			return fmt.Errorf("failed to parse sitemap %s: %w", doc.doc.name, err)
+		}
+		if !s.reader.modifiedSince(entry.LastMod) {
+			continue
+		}
+
+		loc := strings.TrimSpace(entry.Loc)
+		if start.Name.Local == "sitemap" {
+			s.addSitemap(sitemapLocation{loc: loc, depth: doc.depth + 1, parent: doc.doc.name, line: line})
+			return nil
+		}
+
+		for _, image := range entry.Images {
+			imageURL := strings.TrimSpace(image.Loc)
+			if err := validateImageURL(imageURL); err != nil {
+				lineErr := &InputLineError{File: doc.doc.name, Line: line, Text: imageURL, Err: err}
+				s.results = append(s.results, requestResult{err: lineErr})
+				continue
+			}
+			s.results = append(s.results, requestResult{req: ImageRequest{URL: imageURL}})
+		}
+		return nil
+	}
+}
+
+// addSitemap queues a sitemap listed by an index, skipping the ones already
+// read so that indexes listing each other don't loop.
+func (s *sitemapStream) addSitemap(location sitemapLocation) {
+	if s.visited[location.loc] {
+		return
+	}
+	s.visited[location.loc] = true
+
+	var err error
+	if location.depth > maxSitemapDepth {
+		err = fmt.Errorf("sitemap indexes nested more than %d deep", maxSitemapDepth)
+	} else if !isRemoteInput(location.loc) {
+		err = fmt.Errorf("invalid sitemap URL: must be an http or https URL")
+	}
+	if err != nil {
+		s.results = append(s.results, requestResult{err: location.lineError(err)})
+		return
+	}
+
+	s.pending = append(s.pending, location)
+}
+
+func (s *sitemapStream) Close() error {
+	if s.current == nil {
+		return nil
+	}
+
+	err := s.current.doc.Close()
+	s.current = nil
+	return err
+}
+
+// modifiedSince reports whether an entry with the given lastmod is read. An
+// entry whose lastmod is missing or can't be parsed is read.
+func (r *SitemapURLReader) modifiedSince(lastMod string) bool {
+	if r.ModifiedSince.IsZero() {
+		return true
+	}
+
+	modified, err := parseW3CDatetime(lastMod)
+	return err != nil || !modified.Before(r.ModifiedSince)
+}
+
+// w3cDatetimeLayouts are the W3C Datetime formats sitemaps use for lastmod.
+// Fractional seconds are accepted by the layouts with seconds.
+var w3cDatetimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// parseW3CDatetime parses a W3C Datetime. Dates without a time zone are UTC.
+func parseW3CDatetime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range w3cDatetimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid date %q: expected a date such as 2006-01-02 or 2006-01-02T15:04:05Z", value)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func imageSitemap(entries string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"
+        xmlns:image="http://www.google.com/schemas/sitemap-image/1.1">` + entries + `
+</urlset>`
+}
+
+func gzipped(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(data))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+func TestSitemapURLReader_ImageSitemap(t *testing.T) {
+	sitemap := createTempFile(t, []byte(imageSitemap(`
+  <url>
+    <loc>https://example.com/gallery/1</loc>
+    <image:image><image:loc>https://cdn.example.com/1.jpg</image:loc></image:image>
+    <image:image>
+      <image:loc>
+        https://cdn.example.com/2.jpg
+      </image:loc>
+      <image:caption>Two</image:caption>
+    </image:image>
+  </url>
+  <url><loc>https://example.com/about</loc></url>
+  <url>
+    <loc>https://example.com/gallery/2</loc>
+    <image:image><image:loc>not a url</image:loc></image:image>
+    <image:image><image:loc>https://cdn.example.com/3.jpg</image:loc></image:image>
+  </url>`)))
+	defer os.Remove(sitemap)
+
+	stream, err := NewSitemapURLReader(NewStandardHTTPClient()).OpenImageRequests(context.Background(), sitemap)
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	var urls []string
+	var lineErrs []*InputLineError
+	for {
+		req, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		var lineErr *InputLineError
+		if errors.As(err, &lineErr) {
+			lineErrs = append(lineErrs, lineErr)
+			continue
+		}
+		assert.NoError(t, err)
+		urls = append(urls, req.URL)
+	}
+
+	assert.Equal(t, []string{"https://cdn.example.com/1.jpg", "https://cdn.example.com/2.jpg", "https://cdn.example.com/3.jpg"}, urls)
+	if assert.Len(t, lineErrs, 1) {
+		assert.Equal(t, sitemap, lineErrs[0].File)
+		assert.Equal(t, 15, lineErrs[0].Line)
+		assert.Equal(t, "not a url", lineErrs[0].Text)
+	}
+}
+
+func TestSitemapURLReader_Index(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sitemap_index.xml":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>` + server.URL + `/new.xml.gz</loc><lastmod>2024-05-02</lastmod></sitemap>
+  <sitemap><loc>` + server.URL + `/old.xml</loc><lastmod>2024-04-01T10:00:00+02:00</lastmod></sitemap>
+  <sitemap><loc>` + server.URL + `/nested_index.xml</loc></sitemap>
+  <sitemap><loc>` + server.URL + `/missing.xml</loc></sitemap>
+</sitemapindex>`))
+		case "/nested_index.xml":
+			// Lists the index that lists it, which isn't read again
+			w.Write([]byte(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>` + server.URL + `/sitemap_index.xml</loc></sitemap>
+  <sitemap><loc>` + server.URL + `/undated.xml</loc></sitemap>
+</sitemapindex>`))
+		case "/new.xml.gz":
+			w.Write(gzipped(t, imageSitemap(`
+  <url><loc>https://example.com/a</loc><lastmod>2024-05-02</lastmod>
+    <image:image><image:loc>https://cdn.example.com/new.jpg</image:loc></image:image></url>
+  <url><loc>https://example.com/b</loc><lastmod>2024-04-30</lastmod>
+    <image:image><image:loc>https://cdn.example.com/stale.jpg</image:loc></image:image></url>`)))
+		case "/old.xml":
+			w.Write([]byte(imageSitemap(`
+  <url><loc>https://example.com/c</loc>
+    <image:image><image:loc>https://cdn.example.com/old.jpg</image:loc></image:image></url>`)))
+		case "/undated.xml":
+			w.Write([]byte(imageSitemap(`
+  <url><loc>https://example.com/d</loc>
+    <image:image><image:loc>https://cdn.example.com/undated.jpg</image:loc></image:image></url>`)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	reader := NewSitemapURLReader(NewStandardHTTPClient())
+	reader.ModifiedSince = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	stream, err := reader.OpenImageRequests(context.Background(), server.URL+"/sitemap_index.xml")
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	var urls []string
+	var lineErrs []*InputLineError
+	for {
+		req, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		var lineErr *InputLineError
+		if errors.As(err, &lineErr) {
+			lineErrs = append(lineErrs, lineErr)
+			continue
+		}
+		assert.NoError(t, err)
+		urls = append(urls, req.URL)
+	}
+
+	assert.Equal(t, []string{"https://cdn.example.com/new.jpg", "https://cdn.example.com/undated.jpg"}, urls)
+	if assert.Len(t, lineErrs, 1) {
+		assert.Equal(t, server.URL+"/sitemap_index.xml", lineErrs[0].File)
+		assert.Equal(t, 6, lineErrs[0].Line)
+		var statusErr *HTTPStatusError
+		assert.True(t, errors.As(lineErrs[0], &statusErr))
+	}
+}
+
+func TestSitemapURLReader_SlowReading(t *testing.T) {
+	var entries strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&entries, "<url><loc>https://example.com/%d</loc><image:image><image:loc>https://cdn.example.com/%d.jpg</image:loc></image:image></url>\n", i, i)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, imageSitemap(entries.String()))
+	}))
+	defer server.Close()
+
+	// The sitemap is read while images download, long after its request timed out
+	reader := NewSitemapURLReader(NewStandardHTTPClientWithTimeout(200 * time.Millisecond))
+	stream, err := reader.OpenImageRequests(context.Background(), server.URL+"/sitemap.xml")
+	assert.NoError(t, err)
+	defer stream.Close()
+	_, err = stream.Next()
+	assert.NoError(t, err)
+	time.Sleep(300 * time.Millisecond)
+
+	requests, err := drainStream(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, 19999, len(requests))
+}
+
+func TestSitemapURLReader_Errors(t *testing.T) {
+	reader := NewSitemapURLReader(NewStandardHTTPClient())
+
+	_, err := reader.OpenImageRequests(context.Background(), "missing.xml")
+	assert.ErrorContains(t, err, "failed to open sitemap")
+
+	broken := createTempFile(t, []byte(imageSitemap(`<url><loc>https://example.com/a</url>`)))
+	defer os.Remove(broken)
+	_, err = readAllImageRequests(reader, broken)
+	assert.ErrorContains(t, err, "failed to parse sitemap "+broken)
+
+	corrupt := createTempFile(t, []byte{0x1f, 0x8b, 0, 0})
+	defer os.Remove(corrupt)
+	_, err = reader.OpenImageRequests(context.Background(), corrupt)
+	assert.ErrorContains(t, err, "failed to decompress")
+}
+
+func TestParseW3CDatetime(t *testing.T) {
+	for value, want := range map[string]time.Time{
+		"2024":                          time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		"2024-05":                       time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		" 2024-05-02 ":                  time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC),
+		"2024-05-02T10:30+02:00":        time.Date(2024, 5, 2, 8, 30, 0, 0, time.UTC),
+		"2024-05-02T10:30:15Z":          time.Date(2024, 5, 2, 10, 30, 15, 0, time.UTC),
+		"2024-05-02T10:30:15.5-01:00":   time.Date(2024, 5, 2, 11, 30, 15, 5e8, time.UTC),
+		"2024-05-02T10:30:15.123456Z":   time.Date(2024, 5, 2, 10, 30, 15, 123456000, time.UTC),
+		"2024-05-02T10:30:15.000+00:00": time.Date(2024, 5, 2, 10, 30, 15, 0, time.UTC),
+	} {
+		got, err := parseW3CDatetime(value)
+		assert.NoError(t, err, value)
+		assert.True(t, want.Equal(got), "%s: got %v", value, got)
+	}
+
+	_, err := parseW3CDatetime("May 2nd")
+	assert.Error(t, err)
+}
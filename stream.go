@@ -0,0 +1,264 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"path/filepath"
+)
+
+// nextBatch reads up to batchSize requests from the stream. It returns an
+// empty batch once the stream is exhausted.
+func nextBatch(stream ImageRequestStream, batchSize int) ([]ImageRequest, error) {
+	batch := make([]ImageRequest, 0, batchSize)
+	for len(batch) < batchSize {
+		req, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, req)
+	}
+
+	return batch, nil
+}
+
+// rejectingStream skips the invalid lines of a stream, writing them to the
+// report instead of failing.
+type rejectingStream struct {
+	source ImageRequestStream
+	report *RejectedLineReport
+}
+
+func newRejectingStream(source ImageRequestStream, report *RejectedLineReport) *rejectingStream {
+	return &rejectingStream{source: source, report: report}
+}
+
+func (s *rejectingStream) Next() (ImageRequest, error) {
+	for {
+		req, err := s.source.Next()
+		var lineErr *InputLineError
+		if !errors.As(err, &lineErr) {
+			return req, err
+		}
+
+		log.Printf("Skipping invalid input line %v", lineErr)
+		if err := s.report.Write(lineErr); err != nil {
+			return ImageRequest{}, fmt.Errorf("failed to write rejected line report: %v", err)
+		}
+	}
+}
+
+func (s *rejectingStream) Close() error {
+	return s.source.Close()
+}
+
+// normalizingStream rewrites the URLs of a stream into their canonical form
+// and drops the requests seen before: those for the same URL, saved under the
+// same name. Only a 64-bit hash of each request is kept, so memory use stays
+// small even for very long lists.
+type normalizingStream struct {
+	source     ImageRequestStream
+	normalizer *URLNormalizer
+	dedupe     bool
+	seen       map[uint64]struct{}
+
+	// Duplicates is the number of requests dropped.
+	Duplicates int
+}
+
+func newNormalizingStream(source ImageRequestStream, normalizer *URLNormalizer, dedupe bool) *normalizingStream {
+	return &normalizingStream{source: source, normalizer: normalizer, dedupe: dedupe, seen: make(map[uint64]struct{})}
+}
+
+func (s *normalizingStream) Next() (ImageRequest, error) {
+	for {
+		req, err := s.source.Next()
+		if err != nil {
+			return req, err
+		}
+
+		if s.normalizer != nil {
+			req.URL = s.normalizer.Normalize(req.URL)
+		}
+		if !s.dedupe {
+			return req, nil
+		}
+
+		key := hashStrings(req.URL, req.Subdir, req.Filename)
+		if _, ok := s.seen[key]; ok {
+			s.Duplicates++
+			continue
+		}
+		s.seen[key] = struct{}{}
+
+		return req, nil
+	}
+}
+
+func (s *normalizingStream) Close() error {
+	return s.source.Close()
+}
+
+// namingStream numbers the requests of a stream in input order, and names the
+// ones the input didn't name after their URL. A URL keeps the name taken from
+// it unless the download index has that file down for another URL; then it
+// gets the hash of its URL added, or the hash suffixed name it was saved under
+// before. Names given by the input are kept as they are. The stream keeps no
+// state of its own: URLs of the same run that end in the same name are told
+// apart when they are downloaded, see ImageDownloader.claimPath.
+type namingStream struct {
+	source ImageRequestStream
+	// dir is the download directory, which the download index is kept for.
+	dir       string
+	downloads *DownloadIndex
+	index     int
+
+	// Renamed is the number of requests given a hash suffixed name.
+	Renamed int
+}
+
+func newNamingStream(source ImageRequestStream, downloadIndex *DownloadIndex, downloadDir string) *namingStream {
+	return &namingStream{source: source, dir: downloadDir, downloads: downloadIndex}
+}
+
+func (s *namingStream) Next() (ImageRequest, error) {
+	req, err := s.source.Next()
+	if err != nil {
+		return req, err
+	}
+	s.index++
+	req.Index = s.index
+
+	if req.Filename != "" {
+		return req, nil
+	}
+
+	base := urlFileName(req.URL)
+	req.Filename = base
+	if owned, known := s.downloads.owns(s.filePath(req.Subdir, base), req.URL); !known || owned {
+		return req, nil
+	}
+
+	// The name is taken, only now are the hash suffixed ones worth computing
+	names := hashSuffixedNames(base, req.URL)
+	req.Filename = names[len(names)-1]
+	for _, name := range names {
+		if owned, known := s.downloads.owns(s.filePath(req.Subdir, name), req.URL); !known || owned {
+			req.Filename = name
+			break
+		}
+	}
+	s.Renamed++
+
+	return req, nil
+}
+
+// filePath returns the path of the file name in subdir.
+func (s *namingStream) filePath(subdir, name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(subdir), name)
+}
+
+func (s *namingStream) Close() error {
+	return s.source.Close()
+}
+
+// hashStrings returns a 64-bit hash of the strings.
+func hashStrings(parts ...string) uint64 {
+	hash := fnv.New64a()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hash.Sum64()
+}
+
+// priorityStream reorders the requests of a stream by priority, higher first,
+// looking ahead at most window requests. Requests are passed on as they are
+// read until the first one with a priority, so inputs without priorities are
+// never held back. From there on, inputs that fit in the window are ordered
+// completely, longer ones only within the window, which keeps memory use
+// bounded. Requests of the same priority keep their order.
+type priorityStream struct {
+	source   ImageRequestStream
+	window   int
+	ordering bool
+	queue    requestQueue
+	read     int
+	err      error
+}
+
+func newPriorityStream(source ImageRequestStream, window int) *priorityStream {
+	return &priorityStream{source: source, window: window}
+}
+
+func (s *priorityStream) Next() (ImageRequest, error) {
+	if !s.ordering {
+		req, err := s.source.Next()
+		if err != nil || req.Priority == 0 {
+			return req, err
+		}
+		s.ordering = true
+		heap.Push(&s.queue, queuedRequest{req: req, index: s.read})
+		s.read++
+	}
+
+	for s.err == nil && s.queue.Len() < s.window {
+		req, err := s.source.Next()
+		if err != nil {
+			s.err = err
+			break
+		}
+		heap.Push(&s.queue, queuedRequest{req: req, index: s.read})
+		s.read++
+	}
+
+	if s.err != nil && s.err != io.EOF {
+		return ImageRequest{}, s.err
+	}
+	if s.queue.Len() == 0 {
+		return ImageRequest{}, io.EOF
+	}
+
+	return heap.Pop(&s.queue).(queuedRequest).req, nil
+}
+
+func (s *priorityStream) Close() error {
+	return s.source.Close()
+}
+
+// queuedRequest is a request waiting in a priorityStream, with its position in
+// the input to break ties.
+type queuedRequest struct {
+	req   ImageRequest
+	index int
+}
+
+// requestQueue is a heap of queued requests, the highest priority on top.
+type requestQueue []queuedRequest
+
+func (q requestQueue) Len() int { return len(q) }
+
+func (q requestQueue) Less(i, j int) bool {
+	if q[i].req.Priority != q[j].req.Priority {
+		return q[i].req.Priority > q[j].req.Priority
+	}
+	return q[i].index < q[j].index
+}
+
+func (q requestQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *requestQueue) Push(x any) { *q = append(*q, x.(queuedRequest)) }
+
+func (q *requestQueue) Pop() any {
+	old := *q
+	last := old[len(old)-1]
+	old[len(old)-1] = queuedRequest{}
+	*q = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNextBatch(t *testing.T) {
+	stream := &sliceStream{requests: imageRequests(
+		"https://example.com/image1.jpg",
+		"https://example.com/image2.jpg",
+		"https://example.com/image3.jpg",
+		"https://example.com/image4.jpg",
+		"https://example.com/image5.jpg",
+		"https://example.com/image6.jpg",
+		"https://example.com/image7.jpg",
+		"https://example.com/image8.jpg",
+		"https://example.com/image9.jpg",
+		"https://example.com/image10.jpg",
+		"https://example.com/image11.jpg",
+	)}
+
+	var batches [][]ImageRequest
+	for {
+		batch, err := nextBatch(stream, 5)
+		assert.NoError(t, err)
+		if len(batch) == 0 {
+			break
+		}
+		batches = append(batches, batch)
+	}
+
+	assert.Equal(t, [][]ImageRequest{
+		imageRequests("https://example.com/image1.jpg", "https://example.com/image2.jpg", "https://example.com/image3.jpg", "https://example.com/image4.jpg", "https://example.com/image5.jpg"),
+		imageRequests("https://example.com/image6.jpg", "https://example.com/image7.jpg", "https://example.com/image8.jpg", "https://example.com/image9.jpg", "https://example.com/image10.jpg"),
+		imageRequests("https://example.com/image11.jpg"),
+	}, batches)
+}
+
+func TestNextBatch_EmptyStream(t *testing.T) {
+	batch, err := nextBatch(&sliceStream{}, 5)
+	assert.NoError(t, err)
+	assert.Empty(t, batch)
+}
+
+func TestNextBatch_ReadError(t *testing.T) {
+	stream := &sliceStream{requests: imageRequests("https://example.com/image1.jpg"), err: errors.New("bad line")}
+
+	_, err := nextBatch(stream, 5)
+	assert.EqualError(t, err, "bad line")
+}
+
+func TestPriorityStream(t *testing.T) {
+	source := &sliceStream{requests: []ImageRequest{
+		{URL: "a", Priority: 0},
+		{URL: "b", Priority: 5},
+		{URL: "c", Priority: 0},
+		{URL: "d", Priority: 5},
+		{URL: "e", Priority: 9},
+		{URL: "f", Priority: 1},
+	}}
+
+	// Everything from the first priority on fits in the window
+	requests, err := drainStream(newPriorityStream(source, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "e", "b", "d", "f", "c"}, requestURLs(requests))
+
+	// Only 3 requests are looked at ahead of time
+	source.next = 0
+	requests, err = drainStream(newPriorityStream(source, 3))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "e", "d", "f", "c"}, requestURLs(requests))
+}
+
+func TestPriorityStream_NoPriorities(t *testing.T) {
+	source := &sliceStream{requests: imageRequests("a", "b", "c")}
+	stream := newPriorityStream(source, 10)
+
+	// Without priorities nothing is read ahead
+	req, err := stream.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", req.URL)
+	assert.Equal(t, 1, source.next)
+
+	requests, err := drainStream(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, requestURLs(requests))
+}
+
+func TestDownloadImages_StreamsInput(t *testing.T) {
+	const total = 1000
+	stream := &generatedStream{total: total}
+	downloader := &streamCheckingDownloader{stream: stream}
+	helper := &Helper{
+		Downloader:        downloader,
+		URLReader:         &stubURLReader{stream: stream},
+		ImageSizeChecker:  &stubImageSizeChecker{},
+		FileChecker:       NewDefaultFileChecker(),
+		WaitTimeGenerator: NewDefaultWaitTimeGenerator(),
+	}
+	config := &Config{
+		ImageURLFiles:     []string{"generated"},
+		DownloadDirectory: t.TempDir(),
+		BatchSize:         10,
+		MaxImageSize:      -1,
+		FailFast:          true,
+		PriorityWindow:    50,
+	}
+
+	err := helper.DownloadImages(context.Background(), config)
+	assert.NoError(t, err)
+	assert.Equal(t, total, downloader.downloads)
+	// The input is never read further ahead than the window and a batch
+	assert.LessOrEqual(t, downloader.maxAhead, config.PriorityWindow+config.BatchSize)
+	assert.True(t, stream.closed)
+}
+
+// readAllImageRequests opens filePath with reader and collects every request.
+func readAllImageRequests(reader URLReader, filePath string) ([]ImageRequest, error) {
+	stream, err := reader.OpenImageRequests(context.Background(), filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	return drainStream(stream)
+}
+
+func drainStream(stream ImageRequestStream) ([]ImageRequest, error) {
+	var requests []ImageRequest
+	for {
+		req, err := stream.Next()
+		if err == io.EOF {
+			return requests, nil
+		}
+		if err != nil {
+			return requests, err
+		}
+		requests = append(requests, req)
+	}
+}
+
+func requestURLs(requests []ImageRequest) []string {
+	urls := make([]string, len(requests))
+	for i, req := range requests {
+		urls[i] = req.URL
+	}
+	return urls
+}
+
+// sliceStream yields its requests, then err or io.EOF.
+type sliceStream struct {
+	requests []ImageRequest
+	next     int
+	err      error
+}
+
+func (s *sliceStream) Next() (ImageRequest, error) {
+	if s.next < len(s.requests) {
+		s.next++
+		return s.requests[s.next-1], nil
+	}
+	if s.err != nil {
+		return ImageRequest{}, s.err
+	}
+	return ImageRequest{}, io.EOF
+}
+
+func (s *sliceStream) Close() error { return nil }
+
+// generatedStream yields total requests without holding them.
+type generatedStream struct {
+	mu     sync.Mutex
+	total  int
+	read   int
+	closed bool
+}
+
+func (s *generatedStream) Next() (ImageRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.read == s.total {
+		return ImageRequest{}, io.EOF
+	}
+	s.read++
+	return ImageRequest{URL: fmt.Sprintf("https://example.com/image%d.jpg", s.read)}, nil
+}
+
+func (s *generatedStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+type stubURLReader struct {
+	stream ImageRequestStream
+}
+
+func (r *stubURLReader) OpenImageRequests(ctx context.Context, filePath string) (ImageRequestStream, error) {
+	return r.stream, nil
+}
+
+// streamCheckingDownloader records how far ahead of the downloads the stream was read.
+type streamCheckingDownloader struct {
+	mu        sync.Mutex
+	stream    *generatedStream
+	downloads int
+	maxAhead  int
+}
+
+func (d *streamCheckingDownloader) DownloadImage(ctx context.Context, req ImageRequest, downloadDir string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stream.mu.Lock()
+	ahead := d.stream.read - d.downloads
+	d.stream.mu.Unlock()
+	if ahead > d.maxAhead {
+		d.maxAhead = ahead
+	}
+	d.downloads++
+	return nil
+}
+
+func TestNormalizingStream(t *testing.T) {
+	source := &sliceStream{requests: []ImageRequest{
+		{URL: "https://example.com/a.jpg?w=1&h=2"},
+		{URL: "https://EXAMPLE.com:443/a.jpg?h=2&w=1&utm_source=mail"},
+		{URL: "https://example.com/b.jpg"},
+		{URL: "https://example.com/a.jpg?h=2&w=1", Filename: "copy.jpg"},
+		{URL: "https://example.com/b.jpg#top"},
+	}}
+	normalizer, err := newURLNormalizer([]string{
+		NormalizeLowercaseHost, NormalizeRemoveDefaultPort, NormalizeDropFragment, NormalizeSortQuery, NormalizeStripQueryParams,
+	}, []string{"utm_*"})
+	assert.NoError(t, err)
+
+	stream := newNormalizingStream(source, normalizer, true)
+	requests, err := drainStream(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{
+		{URL: "https://example.com/a.jpg?h=2&w=1"},
+		{URL: "https://example.com/b.jpg"},
+		{URL: "https://example.com/a.jpg?h=2&w=1", Filename: "copy.jpg"},
+	}, requests)
+	assert.Equal(t, 2, stream.Duplicates)
+
+	// Without normalization only exact duplicates are dropped
+	source.next = 0
+	stream = newNormalizingStream(source, nil, true)
+	requests, err = drainStream(stream)
+	assert.NoError(t, err)
+	assert.Len(t, requests, 5)
+	assert.Equal(t, 0, stream.Duplicates)
+}
+
+func TestNamingStream(t *testing.T) {
+	source := &sliceStream{requests: []ImageRequest{
+		{URL: "https://a.com/x/1.jpg"},
+		{URL: "https://b.com/y/1.jpg"},
+		{URL: "https://e.com/cover.jpg", Filename: "2.jpg"},
+		{URL: "https://g.com/img.php?id=7", Subdir: "g"},
+	}}
+
+	// Without a download index the names are those of the URLs, collisions
+	// are left to the downloader
+	stream := newNamingStream(source, nil, "")
+	requests, err := drainStream(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, []ImageRequest{
+		{URL: "https://a.com/x/1.jpg", Filename: "1.jpg", Index: 1},
+		{URL: "https://b.com/y/1.jpg", Filename: "1.jpg", Index: 2},
+		{URL: "https://e.com/cover.jpg", Filename: "2.jpg", Index: 3},
+		{URL: "https://g.com/img.php?id=7", Filename: "img.php", Subdir: "g", Index: 4},
+	}, requests)
+	assert.Equal(t, 0, stream.Renamed)
+}
+
+func TestNamingStream_DownloadIndex(t *testing.T) {
+	dir := t.TempDir()
+	const first, second = "https://a.com/photo.jpg", "https://b.com/photo.jpg"
+	suffixed := hashSuffixedName("photo.jpg", second, 8)
+
+	// An earlier run saved both URLs
+	index, err := LoadDownloadIndex(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, index.record(filepath.Join(dir, "photo.jpg"), first))
+	assert.NoError(t, index.record(filepath.Join(dir, suffixed), second))
+	assert.NoError(t, index.Close())
+
+	// Whatever the order and the other URLs of a later run, they keep their names
+	index, err = LoadDownloadIndex(dir)
+	assert.NoError(t, err)
+	for _, urls := range [][]string{{second, first}, {second}, {"https://c.com/photo.jpg", first}} {
+		requests, err := drainStream(newNamingStream(&sliceStream{requests: imageRequests(urls...)}, index, dir))
+		assert.NoError(t, err)
+		for _, req := range requests {
+			switch req.URL {
+			case first:
+				assert.Equal(t, "photo.jpg", req.Filename)
+			case second:
+				assert.Equal(t, suffixed, req.Filename)
+			default:
+				// The bare name is taken by a file of another URL
+				assert.Equal(t, hashSuffixedName("photo.jpg", req.URL, 8), req.Filename)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// validateImageURL checks that rawURL is an absolute http or https URL. A URL
+// with brace groups is checked through its first expansion.
+func validateImageURL(rawURL string) error {
+	expanded := rawURL
+	if pattern, ok := parseBracePattern(rawURL); ok {
+		expanded = pattern.first()
+	}
+
+	parsed, err := url.Parse(expanded)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("invalid URL %q: the scheme must be http or https", rawURL)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("invalid URL %q: missing host", rawURL)
+	}
+
+	return nil
+}
+
+// URL normalization rules for the normalize_urls key.
+const (
+	NormalizeLowercaseHost     = "lowercase_host"
+	NormalizeRemoveDefaultPort = "remove_default_port"
+	NormalizeDropFragment      = "drop_fragment"
+	NormalizeSortQuery         = "sort_query"
+	NormalizeStripQueryParams  = "strip_query_params"
+)
+
+// URLNormalizer rewrites URLs into a canonical form, so that different
+// spellings of the same image URL compare equal.
+type URLNormalizer struct {
+	LowercaseHost     bool
+	RemoveDefaultPort bool
+	DropFragment      bool
+	// SortQuery orders the query parameters by name. Repeated parameters keep
+	// their order.
+	SortQuery bool
+	// StripQueryParams are path.Match patterns, like utm_*, of the query
+	// parameters to remove.
+	StripQueryParams []string
+}
+
+// newURLNormalizer creates a normalizer applying the named rules. It returns
+// nil if there are none.
+func newURLNormalizer(rules []string, stripQueryParams []string) (*URLNormalizer, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	n := &URLNormalizer{}
+	for _, rule := range rules {
+		switch strings.ToLower(strings.TrimSpace(rule)) {
+		case NormalizeLowercaseHost:
+			n.LowercaseHost = true
+		case NormalizeRemoveDefaultPort:
+			n.RemoveDefaultPort = true
+		case NormalizeDropFragment:
+			n.DropFragment = true
+		case NormalizeSortQuery:
+			n.SortQuery = true
+		case NormalizeStripQueryParams:
+			n.StripQueryParams = stripQueryParams
+		default:
+			return nil, fmt.Errorf("unknown URL normalization rule %q", rule)
+		}
+	}
+
+	for _, pattern := range n.StripQueryParams {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid query parameter pattern %q: %v", pattern, err)
+		}
+	}
+
+	return n, nil
+}
+
+// Normalize returns the canonical form of rawURL. URLs that can't be parsed
+// are returned as they are.
+func (n *URLNormalizer) Normalize(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	if n.LowercaseHost {
+		parsed.Host = strings.ToLower(parsed.Host)
+	}
+	if n.RemoveDefaultPort {
+		port := parsed.Port()
+		if (parsed.Scheme == "http" && port == "80") || (parsed.Scheme == "https" && port == "443") {
+			parsed.Host = strings.TrimSuffix(parsed.Host, ":"+port)
+		}
+	}
+	if n.DropFragment {
+		parsed.Fragment = ""
+		parsed.RawFragment = ""
+	}
+	if n.SortQuery || len(n.StripQueryParams) > 0 {
+		parsed.RawQuery = n.normalizeQuery(parsed.RawQuery)
+		if parsed.RawQuery == "" {
+			parsed.ForceQuery = false
+		}
+	}
+
+	return parsed.String()
+}
+
+// normalizeQuery strips and sorts the parameters of the raw query, leaving
+// their encoding alone.
+func (n *URLNormalizer) normalizeQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param != "" && !n.stripped(queryParamName(param)) {
+			params = append(params, param)
+		}
+	}
+
+	if n.SortQuery {
+		sort.SliceStable(params, func(i, j int) bool {
+			return queryParamName(params[i]) < queryParamName(params[j])
+		})
+	}
+
+	return strings.Join(params, "&")
+}
+
+func (n *URLNormalizer) stripped(name string) bool {
+	for _, pattern := range n.StripQueryParams {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// queryParamName returns the decoded name of a raw name=value query parameter.
+func queryParamName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		return unescaped
+	}
+	return name
+}
@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestValidateImageURL(t *testing.T) {
+	for _, rawURL := range []string{
+		"https://example.com/image.jpg",
+		"HTTP://example.com:8080/a/b.png?size=large",
+	} {
+		if err := validateImageURL(rawURL); err != nil {
+			t.Errorf("Expected %q to be valid, but got %v", rawURL, err)
+		}
+	}
+
+	for _, rawURL := range []string{
+		"",
+		"example.com/image.jpg",
+		"/images/a.jpg",
+		"ftp://example.com/image.jpg",
+		"https:///image.jpg",
+		"https://exa mple.com/image.jpg",
+		"http://[::1/image.jpg",
+	} {
+		if err := validateImageURL(rawURL); err == nil {
+			t.Errorf("Expected %q to be invalid, but got nil", rawURL)
+		}
+	}
+}
+
+func TestURLNormalizer_Normalize(t *testing.T) {
+	normalizer, err := newURLNormalizer([]string{
+		NormalizeLowercaseHost, NormalizeRemoveDefaultPort, NormalizeDropFragment, NormalizeSortQuery, NormalizeStripQueryParams,
+	}, []string{"utm_*", "fbclid"})
+	if err != nil {
+		t.Fatalf("Failed to create normalizer: %v", err)
+	}
+
+	tests := map[string]string{
+		"https://Example.COM:443/Images/A.jpg":                         "https://example.com/Images/A.jpg",
+		"http://example.com:80/a.jpg":                                  "http://example.com/a.jpg",
+		"https://example.com:8443/a.jpg":                               "https://example.com:8443/a.jpg",
+		"http://example.com:443/a.jpg":                                 "http://example.com:443/a.jpg",
+		"https://example.com/a.jpg#section":                            "https://example.com/a.jpg",
+		"https://example.com/a.jpg?w=100&h=50":                         "https://example.com/a.jpg?h=50&w=100",
+		"https://example.com/a.jpg?utm_source=x&w=1&fbclid=y":          "https://example.com/a.jpg?w=1",
+		"https://example.com/a.jpg?utm_source=x&utm_medium=y":          "https://example.com/a.jpg",
+		"https://example.com/a.jpg?tag=b&size=1&tag=a":                 "https://example.com/a.jpg?size=1&tag=b&tag=a",
+		"https://example.com/a.jpg?q=a%20b&p=c+d":                      "https://example.com/a.jpg?p=c+d&q=a%20b",
+		"https://[2001:DB8::1]:443/a.jpg":                              "https://[2001:db8::1]/a.jpg",
+		"https://example.com/a%2Fb.jpg?x=1#frag":                       "https://example.com/a%2Fb.jpg?x=1",
+		"https://example.com/a.jpg?":                                   "https://example.com/a.jpg",
+		"https://example.com/a.jpg?utm_campaign=spring&Utm_Source=web": "https://example.com/a.jpg?Utm_Source=web",
+	}
+
+	for rawURL, expected := range tests {
+		if actual := normalizer.Normalize(rawURL); actual != expected {
+			t.Errorf("Expected %q to normalize to %q, but got %q", rawURL, expected, actual)
+		}
+	}
+}
+
+func TestNewURLNormalizer(t *testing.T) {
+	normalizer, err := newURLNormalizer(nil, []string{"utm_*"})
+	if err != nil || normalizer != nil {
+		t.Errorf("Expected no normalizer without rules, but got %v (%v)", normalizer, err)
+	}
+
+	if _, err := newURLNormalizer([]string{"lowercase_path"}, nil); err == nil {
+		t.Errorf("Expected an error for an unknown rule, but got nil")
+	}
+
+	if _, err := newURLNormalizer([]string{NormalizeStripQueryParams}, []string{"utm_["}); err == nil {
+		t.Errorf("Expected an error for an invalid pattern, but got nil")
+	}
+
+	// Only the rules asked for are applied
+	normalizer, err = newURLNormalizer([]string{NormalizeDropFragment}, []string{"utm_*"})
+	if err != nil {
+		t.Fatalf("Failed to create normalizer: %v", err)
+	}
+	if actual := normalizer.Normalize("https://Example.com/a.jpg?utm_source=x#top"); actual != "https://Example.com/a.jpg?utm_source=x" {
+		t.Errorf("Unexpected normalized URL %q", actual)
+	}
+}
+
+func TestValidateImageURL_BracePatterns(t *testing.T) {
+	if err := validateImageURL("https://{a,b}.example.com/img_{0001..2500}.jpg"); err != nil {
+		t.Errorf("Expected a valid pattern, but got %v", err)
+	}
+	if err := validateImageURL("{ftp,http}://example.com/a.jpg"); err == nil {
+		t.Errorf("Expected an error for an ftp first expansion, but got nil")
+	}
+}